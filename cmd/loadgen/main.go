@@ -0,0 +1,28 @@
+// Command loadgen simulates concurrent trades against a running trades service, as described by
+// a load scenario file, and reports their outcomes and latencies.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/NOVAPokemon/trades/internal/service"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "usage: %s scenario.json\n", os.Args[0])
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := service.RunLoad(flag.Arg(0), os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,30 @@
+// Command replay drives the trade in an exported audit log through the handlers of the trades
+// service, offline, and fails if it does not end as recorded. It takes the same configuration
+// flags as the service.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/NOVAPokemon/trades/internal/service"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] audit_log.json\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := service.Replay(flag.Arg(0), os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	accountStoreEnvVar = "TRADES_ACCOUNT_STORE"
+
+	memoryAccountStore = "memory"
+	mongoAccountStore  = "mongo"
+
+	accountsCollectionName = "TradeAccounts"
+)
+
+// accountRegistry remembers when trades first saw each trainer, which the trading age rule counts
+// from, since the trainers service does not keep when an account was created. FirstSeen records
+// now for a trainer seen for the first time.
+type accountRegistry interface {
+	FirstSeen(username string, now time.Time) (time.Time, error)
+}
+
+func newAccountRegistryFromEnv() (accountRegistry, error) {
+	storeType, exists := os.LookupEnv(accountStoreEnvVar)
+	if !exists {
+		storeType = memoryAccountStore
+	}
+
+	switch storeType {
+	case memoryAccountStore:
+		return &memoryAccounts{firstSeen: map[string]time.Time{}}, nil
+	case mongoAccountStore:
+		url, exists := os.LookupEnv(mongoURLEnvVar)
+		if !exists {
+			return nil, errorNoMongoURL
+		}
+		return newMongoAccounts(url)
+	default:
+		return nil, newInvalidAccountStoreError(storeType)
+	}
+}
+
+// memoryAccounts is the default registry. It holds one entry per trainer seen until restarted,
+// so deployments relying on the trading age rule have to pick the mongo registry.
+type memoryAccounts struct {
+	firstSeen map[string]time.Time
+	lock      sync.Mutex
+}
+
+func (a *memoryAccounts) FirstSeen(username string, now time.Time) (time.Time, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if firstSeen, ok := a.firstSeen[username]; ok {
+		return firstSeen, nil
+	}
+
+	a.firstSeen[username] = now
+	return now, nil
+}
+
+type accountDocument struct {
+	Username  string    `bson:"_id"`
+	FirstSeen time.Time `bson:"first_seen"`
+}
+
+type mongoAccounts struct {
+	collection *mongo.Collection
+}
+
+func newMongoAccounts(url string) (*mongoAccounts, error) {
+	collection, err := getMongoCollection(url, accountsCollectionName)
+	if err != nil {
+		return nil, wrapAccountRegistryError(err)
+	}
+
+	return &mongoAccounts{collection: collection}, nil
+}
+
+// FirstSeen only sets the first time on insert, so concurrent calls for a new trainer agree on it
+func (a *mongoAccounts) FirstSeen(username string, now time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	update := bson.M{"$setOnInsert": bson.M{"first_seen": now}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var account accountDocument
+	err := a.collection.FindOneAndUpdate(ctx, bson.M{"_id": username}, update, opts).Decode(&account)
+	if err != nil {
+		return time.Time{}, wrapAccountRegistryError(err)
+	}
+
+	return account.FirstSeen, nil
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	ws "github.com/NOVAPokemon/utils/websockets"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit actions besides the trade messages, which are recorded with their own type along with
+// what they were answered
+const (
+	auditLobbyCreated        = "LOBBY_CREATED"
+	auditTrainerJoined       = "TRAINER_JOINED"
+	auditTradeStarted        = "TRADE_STARTED"
+	auditInviteRejected      = "INVITE_REJECTED"
+	auditTrainerDisconnected = "TRAINER_DISCONNECTED"
+	auditTrainerReconnected  = "TRAINER_RECONNECTED"
+	auditCommitStep          = "COMMIT_STEP"
+	auditCommitRolledBack    = "COMMIT_ROLLED_BACK"
+	auditCommitRecovered     = "COMMIT_RECOVERED"
+	auditTradeFinished       = "TRADE_FINISHED"
+)
+
+const (
+	auditStoreEnvVar = "TRADES_AUDIT_STORE"
+
+	memoryAuditStore = "memory"
+	mongoAuditStore  = "mongo"
+
+	auditCollectionName = "TradeAudit"
+)
+
+// auditEvent is something that happened in a lobby, or in the commit of a trade offer, whose id
+// is kept as LobbyId. Trainer is left empty for what the service did on its own.
+type auditEvent struct {
+	LobbyId   string                 `json:"lobby_id" bson:"lobby_id"`
+	Action    string                 `json:"action" bson:"action"`
+	Trainer   string                 `json:"trainer,omitempty" bson:"trainer,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty" bson:"data,omitempty"`
+	TrackInfo *ws.TrackedInfo        `json:"track_info,omitempty" bson:"track_info,omitempty"`
+	Timestamp time.Time              `json:"timestamp" bson:"timestamp"`
+}
+
+// auditLog is append only. Events of a lobby are listed in the order they were appended.
+type auditLog interface {
+	Append(event *auditEvent) error
+	ListByLobby(lobbyId string) ([]*auditEvent, error)
+}
+
+func newAuditLogFromEnv() (auditLog, error) {
+	storeType, exists := os.LookupEnv(auditStoreEnvVar)
+	if !exists {
+		storeType = memoryAuditStore
+	}
+
+	switch storeType {
+	case memoryAuditStore:
+		return &memoryAudit{events: map[string][]*auditEvent{}}, nil
+	case mongoAuditStore:
+		url, exists := os.LookupEnv(mongoURLEnvVar)
+		if !exists {
+			return nil, errorNoMongoURL
+		}
+		return newMongoAudit(url)
+	default:
+		return nil, newInvalidAuditStoreError(storeType)
+	}
+}
+
+// recordAuditEvent appends to the audit log. Failing to do so does not affect the trade, so
+// errors are only logged.
+func recordAuditEvent(lobbyId, action, trainer string, data map[string]interface{},
+	trackInfo *ws.TrackedInfo) {
+	event := &auditEvent{
+		LobbyId:   lobbyId,
+		Action:    action,
+		Trainer:   trainer,
+		Data:      data,
+		TrackInfo: trackInfo,
+		Timestamp: time.Now(),
+	}
+
+	if err := audit.Append(event); err != nil {
+		log.Error(wrapAuditLogError(err))
+	}
+}
+
+// messageAnswer is what a trade message was answered with
+type messageAnswer struct {
+	Type string    `json:"type"`
+	Code errorCode `json:"code,omitempty"`
+	Info string    `json:"info,omitempty"`
+}
+
+func answerOf(answerMsg *ws.WebsocketMsg) messageAnswer {
+	if answerMsg == nil || answerMsg.Content == nil {
+		return messageAnswer{}
+	}
+
+	answer := messageAnswer{Type: answerMsg.Content.AppMsgType}
+	if errorMsg, ok := answerMsg.Content.Data.(ErrorTradeMessage); ok {
+		answer.Code = errorMsg.Code
+		answer.Info = errorMsg.Info
+	}
+
+	return answer
+}
+
+// auditMessage records a trade message as the trainer sent it, applied or not, with its answer
+func (lobby *tradeLobby) auditMessage(wsMsg *ws.WebsocketMsg, trainerNum int, answerMsg *ws.WebsocketMsg) {
+	content := wsMsg.Content
+	if content == nil {
+		recordAuditEvent(lobby.wsLobby.Id, "", lobby.trainers[trainerNum],
+			map[string]interface{}{"no_content": true, "answer": answerOf(answerMsg)}, nil)
+		return
+	}
+
+	recordAuditEvent(lobby.wsLobby.Id, content.AppMsgType, lobby.trainers[trainerNum],
+		map[string]interface{}{"message": content.Data, "answer": answerOf(answerMsg)}, content.RequestTrack)
+}
+
+func auditStep(lobbyId string, step commitStep, err error) {
+	data := map[string]interface{}{"step": step.description}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+
+	recordAuditEvent(lobbyId, auditCommitStep, "", data, nil)
+}
+
+func auditRollback(lobbyId string, cause, rollbackErr error) {
+	data := map[string]interface{}{"cause": cause.Error()}
+	if rollbackErr != nil {
+		data["error"] = rollbackErr.Error()
+	}
+
+	recordAuditEvent(lobbyId, auditCommitRolledBack, "", data, nil)
+}
+
+// memoryAudit is the default store. It never drops events until restarted, so deployments
+// that need a lasting audit log have to pick the mongo store.
+type memoryAudit struct {
+	events map[string][]*auditEvent
+	lock   sync.RWMutex
+}
+
+func (a *memoryAudit) Append(event *auditEvent) error {
+	a.lock.Lock()
+	a.events[event.LobbyId] = append(a.events[event.LobbyId], event)
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *memoryAudit) ListByLobby(lobbyId string) ([]*auditEvent, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return append([]*auditEvent{}, a.events[lobbyId]...), nil
+}
+
+// mongoAudit relies on the generated ids growing with insertion to keep events in order
+type mongoAudit struct {
+	collection *mongo.Collection
+}
+
+func newMongoAudit(url string) (*mongoAudit, error) {
+	collection, err := getMongoCollection(url, auditCollectionName)
+	if err != nil {
+		return nil, wrapAuditLogError(err)
+	}
+
+	return &mongoAudit{collection: collection}, nil
+}
+
+func (a *mongoAudit) Append(event *auditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	if _, err := a.collection.InsertOne(ctx, event); err != nil {
+		return wrapAuditLogError(err)
+	}
+
+	return nil
+}
+
+func (a *mongoAudit) ListByLobby(lobbyId string) ([]*auditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	cursor, err := a.collection.Find(ctx, bson.M{"lobby_id": lobbyId},
+		options.Find().SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, wrapAuditLogError(err)
+	}
+
+	var events []*auditEvent
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, wrapAuditLogError(err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,339 @@
+package service
+
+import (
+	"flag"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const conservationCheckInterval = 5 * time.Second
+
+var chaosFlag = flag.Bool("chaos", false, "inject failures as set in the chaos section of the configuration")
+
+// chaosSettings are read from the chaos section of the configuration and only used with -chaos.
+// Rates are the chance of each call to the trainers service failing and of each websocket frame
+// being dropped, delayed by up to MaxDelay, or having its connection killed. A Seed of zero
+// seeds from the clock.
+type chaosSettings struct {
+	ServiceFailureRate float64  `json:"service_failure_rate"`
+	DropRate           float64  `json:"drop_rate"`
+	DelayRate          float64  `json:"delay_rate"`
+	MaxDelay           duration `json:"max_delay"`
+	KillRate           float64  `json:"kill_rate"`
+	Seed               int64    `json:"seed"`
+}
+
+func defaultChaosSettings() chaosSettings {
+	return chaosSettings{
+		ServiceFailureRate: 0.05,
+		DropRate:           0.01,
+		DelayRate:          0.1,
+		MaxDelay:           duration(500 * time.Millisecond),
+		KillRate:           0.005,
+	}
+}
+
+func (settings *chaosSettings) validate() error {
+	rates := map[string]float64{
+		"chaos.service_failure_rate": settings.ServiceFailureRate,
+		"chaos.drop_rate":            settings.DropRate,
+		"chaos.delay_rate":           settings.DelayRate,
+		"chaos.kill_rate":            settings.KillRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return newInvalidConfigError(name, "must be between 0 and 1")
+		}
+	}
+
+	if settings.MaxDelay < 0 {
+		return newInvalidConfigError("chaos.max_delay", "must not be negative")
+	}
+
+	return nil
+}
+
+// chaosInjector decides when failures happen, from a single source of randomness shared by
+// every connection and request
+type chaosInjector struct {
+	settings chaosSettings
+	random   *rand.Rand
+	lock     sync.Mutex
+}
+
+// enableChaos makes the trainers service and the websockets of trades fail as the settings say.
+// With fake services, whether items and coins are conserved is checked as well, skipping the checks
+// while commitsJournal has commits pending.
+func enableChaos(settings chaosSettings, fakes *fakeTrainers, commitsJournal tradeJournal) {
+	seed := settings.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	chaos := &chaosInjector{
+		settings: settings,
+		random:   rand.New(rand.NewSource(seed)),
+	}
+
+	newServiceClient := newTrainersClient
+	newTrainersClient = func() trainersService {
+		return chaosTrainers{trainersService: newServiceClient(), chaos: chaos}
+	}
+	commsManager = chaosManager{CommunicationManager: commsManager, chaos: chaos}
+
+	if fakes != nil {
+		go watchConservation(fakes, commitsJournal)
+	}
+
+	log.Warnf("chaos mode enabled with seed %d: %+v", seed, settings)
+}
+
+func (c *chaosInjector) roll(rate float64) bool {
+	if rate == 0 {
+		return false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.random.Float64() < rate
+}
+
+func (c *chaosInjector) delay() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Duration(c.random.Int63n(int64(c.settings.MaxDelay) + 1))
+}
+
+// chaosManager drops, delays and kills the websockets of trades. Frames are dropped both ways,
+// while connections are only killed when reading, which is when trainers are in a lobby.
+type chaosManager struct {
+	ws.CommunicationManager
+	chaos *chaosInjector
+}
+
+func (m chaosManager) ReadMessageFromConn(conn *websocket.Conn) (*ws.WebsocketMsg, error) {
+	for {
+		msg, err := m.CommunicationManager.ReadMessageFromConn(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case m.chaos.roll(m.chaos.settings.KillRate):
+			log.Warnf("chaos: killing connection from %s", conn.RemoteAddr())
+			_ = conn.Close()
+			return nil, errorChaosKilledConn
+		case m.chaos.roll(m.chaos.settings.DropRate):
+			log.Warnf("chaos: dropping frame from %s", conn.RemoteAddr())
+			continue
+		case m.chaos.roll(m.chaos.settings.DelayRate):
+			time.Sleep(m.chaos.delay())
+		}
+
+		return msg, nil
+	}
+}
+
+func (m chaosManager) WriteGenericMessageToConn(conn *websocket.Conn, msg *ws.WebsocketMsg) error {
+	if m.chaos.roll(m.chaos.settings.DropRate) {
+		log.Warnf("chaos: dropping frame to %s", conn.RemoteAddr())
+		return nil
+	}
+
+	if m.chaos.roll(m.chaos.settings.DelayRate) {
+		time.Sleep(m.chaos.delay())
+	}
+
+	return m.CommunicationManager.WriteGenericMessageToConn(conn, msg)
+}
+
+// chaosTrainers fails calls to the trainers service either before they reach it or after they
+// were applied, as if the response was lost
+type chaosTrainers struct {
+	trainersService
+	chaos *chaosInjector
+}
+
+func (t chaosTrainers) inject(method string, call func() error) error {
+	if !t.chaos.roll(t.chaos.settings.ServiceFailureRate) {
+		return call()
+	}
+
+	if t.chaos.roll(0.5) {
+		log.Warnf("chaos: failing %s before calling the trainers service", method)
+		return newInjectedFailureError(method)
+	}
+
+	if err := call(); err != nil {
+		return err
+	}
+
+	log.Warnf("chaos: losing the response of %s", method)
+	return newInjectedFailureError(method)
+}
+
+func (t chaosTrainers) GetTrainerByUsername(username string) (trainer *utils.Trainer, err error) {
+	err = t.inject("GetTrainerByUsername", func() error {
+		trainer, err = t.trainersService.GetTrainerByUsername(username)
+		return err
+	})
+	return trainer, err
+}
+
+func (t chaosTrainers) VerifyItems(username, hash, authToken string) (valid *bool, err error) {
+	err = t.inject("VerifyItems", func() error {
+		valid, err = t.trainersService.VerifyItems(username, hash, authToken)
+		return err
+	})
+	return valid, err
+}
+
+func (t chaosTrainers) VerifyPokemons(username string, hashes map[string]string,
+	authToken string) (valid *bool, err error) {
+	err = t.inject("VerifyPokemons", func() error {
+		valid, err = t.trainersService.VerifyPokemons(username, hashes, authToken)
+		return err
+	})
+	return valid, err
+}
+
+func (t chaosTrainers) VerifyTrainerStats(username, hash, authToken string) (valid *bool, err error) {
+	err = t.inject("VerifyTrainerStats", func() error {
+		valid, err = t.trainersService.VerifyTrainerStats(username, hash, authToken)
+		return err
+	})
+	return valid, err
+}
+
+func (t chaosTrainers) RemoveItems(username string, itemIds []string,
+	authToken string) (removed map[string]items.Item, err error) {
+	err = t.inject("RemoveItems", func() error {
+		removed, err = t.trainersService.RemoveItems(username, itemIds, authToken)
+		return err
+	})
+	return removed, err
+}
+
+func (t chaosTrainers) AddItems(username string, toAdd []items.Item,
+	authToken string) (added map[string]items.Item, err error) {
+	err = t.inject("AddItems", func() error {
+		added, err = t.trainersService.AddItems(username, toAdd, authToken)
+		return err
+	})
+	return added, err
+}
+
+func (t chaosTrainers) AddPokemonToTrainer(username string, pokemon pokemons.Pokemon) (added *pokemons.Pokemon,
+	err error) {
+	err = t.inject("AddPokemonToTrainer", func() error {
+		added, err = t.trainersService.AddPokemonToTrainer(username, pokemon)
+		return err
+	})
+	return added, err
+}
+
+func (t chaosTrainers) RemovePokemonFromTrainer(username, pokemonId string) error {
+	return t.inject("RemovePokemonFromTrainer", func() error {
+		return t.trainersService.RemovePokemonFromTrainer(username, pokemonId)
+	})
+}
+
+func (t chaosTrainers) UpdateTrainerStats(username string, stats utils.TrainerStats,
+	authToken string) (updated *utils.TrainerStats, err error) {
+	err = t.inject("UpdateTrainerStats", func() error {
+		updated, err = t.trainersService.UpdateTrainerStats(username, stats, authToken)
+		return err
+	})
+	return updated, err
+}
+
+func (t chaosTrainers) ItemsTokenFor(username, authToken string) (itemsToken string, err error) {
+	err = t.inject("ItemsTokenFor", func() error {
+		itemsToken, err = t.trainersService.ItemsTokenFor(username, authToken)
+		return err
+	})
+	return itemsToken, err
+}
+
+func (t chaosTrainers) PokemonTokensFor(username, authToken string) (pokemonTokens []string, err error) {
+	err = t.inject("PokemonTokensFor", func() error {
+		pokemonTokens, err = t.trainersService.PokemonTokensFor(username, authToken)
+		return err
+	})
+	return pokemonTokens, err
+}
+
+func (t chaosTrainers) StatsTokenFor(username, authToken string) (statsToken string, err error) {
+	err = t.inject("StatsTokenFor", func() error {
+		statsToken, err = t.trainersService.StatsTokenFor(username, authToken)
+		return err
+	})
+	return statsToken, err
+}
+
+// watchConservation periodically checks that the fake trainers still own every item and pokemon
+// they started with, once each, and as many coins in total. Checks are skipped while a commit is
+// in the journal, since commits remove what is traded before adding it to the recipients.
+func watchConservation(fakes *fakeTrainers, commitsJournal tradeJournal) {
+	ticker := time.NewTicker(conservationCheckInterval)
+	defer ticker.Stop()
+
+	busy := func() bool {
+		return commitsPending(commitsJournal)
+	}
+
+	for range ticker.C {
+		census, taken := fakes.census(busy)
+		if !taken {
+			continue
+		}
+
+		duplicated, lost := census.compare(fakes.initial)
+		if len(duplicated) == 0 && len(lost) == 0 && census.coins == fakes.initial.coins {
+			log.Info("chaos: items, pokemons and coins conserved")
+			continue
+		}
+
+		log.Errorf("chaos: conservation broken, duplicated %v, lost %v, coins %d instead of %d",
+			duplicated, lost, census.coins, fakes.initial.coins)
+	}
+}
+
+func commitsPending(commitsJournal tradeJournal) bool {
+	entries, err := commitsJournal.Pending()
+	if err != nil {
+		log.Warn(wrapJournalError(err))
+		return true
+	}
+
+	return len(entries) > 0
+}
+
+// compare finds the ids owned by more than one trainer and the ones initially owned that no
+// trainer owns anymore
+func (c fakeCensus) compare(initial fakeCensus) (duplicated []string, lost []string) {
+	for id, owners := range c.owners {
+		if owners > 1 {
+			duplicated = append(duplicated, id)
+		}
+	}
+
+	for id := range initial.owners {
+		if c.owners[id] == 0 {
+			lost = append(lost, id)
+		}
+	}
+
+	sort.Strings(duplicated)
+	sort.Strings(lost)
+	return duplicated, lost
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/tokens"
+	ws "github.com/NOVAPokemon/utils/websockets"
+)
+
+// handleOfferCoinsMessage sets how many coins the trainer gives to the recipient. Offering no
+// coins takes back the ones offered before.
+func (lobby *tradeLobby) handleOfferCoinsMessage(trackInfo *ws.TrackedInfo, coinsMsg *OfferCoinsMessage,
+	trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	if coinsMsg.Amount < 0 {
+		return ErrorTradeMessage{
+			Code:  codeInvalidCoins,
+			Info:  fmt.Sprintf("can not offer %d coins", coinsMsg.Amount),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	player := &trade.Players[trainerNum]
+	if coinsMsg.Amount == 0 {
+		player.Coins = 0
+		player.CoinsRecipient = ""
+		resetAcceptance(trade)
+		return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+	}
+
+	if !lobby.hasStats(trainerNum) {
+		return ErrorTradeMessage{
+			Code:  codeStatsTokenRequired,
+			Info:  "join with a stats token to offer coins",
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if balance := lobby.initialStats[trainerNum].Coins; coinsMsg.Amount > balance {
+		return ErrorTradeMessage{
+			Code:  codeNotEnoughCoins,
+			Info:  fmt.Sprintf("you only have %d coins", balance),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	recipient, ok := lobby.counterparty(trainerNum, coinsMsg.Recipient)
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeInvalidRecipient,
+			Info:  fmt.Sprintf("%s can not receive coins", coinsMsg.Recipient),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if recipientNum, _ := lobby.trainerNum(recipient); !lobby.hasStats(recipientNum) {
+		return ErrorTradeMessage{
+			Code:  codeStatsTokenRequired,
+			Info:  fmt.Sprintf("%s joined without a stats token and can not receive coins", recipient),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	player.Coins = coinsMsg.Amount
+	player.CoinsRecipient = recipient
+	resetAcceptance(trade)
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}
+
+// extractAndVerifyStats reads the stats token of a request, which holds the coins the trainer
+// can offer, and checks with the trainers service that it is still current. The token is only
+// needed to give or receive coins, so without one the stats and hash returned are empty.
+func extractAndVerifyStats(trainersClient trainersService, username, authToken string,
+	header http.Header) (utils.TrainerStats, string, error) {
+	if header.Get(tokens.StatsTokenHeaderName) == "" {
+		return utils.TrainerStats{}, "", nil
+	}
+
+	statsClaims, err := verifier.StatsToken(header)
+	if err != nil {
+		return utils.TrainerStats{}, "", err
+	}
+
+	valid, err := trainersClient.VerifyTrainerStats(username, statsClaims.TrainerHash, authToken)
+	if err != nil {
+		return utils.TrainerStats{}, "", err
+	}
+
+	if !*valid {
+		return utils.TrainerStats{}, "", tokens.ErrorInvalidStatsToken
+	}
+
+	return statsClaims.TrainerStats, statsClaims.TrainerHash, nil
+}
+
+// hasStats tells whether the trainer joined with a stats token
+func (lobby *tradeLobby) hasStats(trainerNum int) bool {
+	return lobby.withStats[trainerNum]
+}
+
+func tradedCoins(trade *tradeStatus) bool {
+	for _, player := range trade.Players {
+		if player.Coins > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// coinBalances computes the balance of every trainer once the coins of the entry are exchanged
+func coinBalances(entry *journalEntry) []int {
+	balances := append([]int{}, entry.Balances...)
+	for giver, coins := range entry.Coins {
+		if coins == 0 {
+			continue
+		}
+
+		recipient := coinsRecipient(entry.Trainers, entry.CoinsRecipients, giver)
+		balances[giver] -= coins
+		balances[recipient] += coins
+	}
+
+	return balances
+}
+
+func coinsRecipient(trainers []string, recipients []string, giver int) int {
+	if giver < len(recipients) {
+		for trainerNum, trainer := range trainers {
+			if trainer == recipients[giver] {
+				return trainerNum
+			}
+		}
+	}
+
+	return (giver + 1) % len(trainers)
+}
+
+// coinsStep adds delta coins to the trainer, taking them when negative. The change is applied
+// to the balance read right before writing, so coins the trainer earns elsewhere meanwhile are
+// kept, and compensating takes back only the delta. balance is what the trainer had when the
+// commit started, which applied compares against to tell whether the delta is in place.
+func coinsStep(trainersClient trainersService, username, authToken string, balance, delta int) commitStep {
+	description := fmt.Sprintf("adding %d coins to %s", delta, username)
+	if delta < 0 {
+		description = fmt.Sprintf("taking %d coins from %s", -delta, username)
+	}
+
+	return commitStep{
+		description: description,
+		apply: func() error {
+			return addCoins(trainersClient, username, authToken, delta)
+		},
+		compensate: func() error {
+			return addCoins(trainersClient, username, authToken, -delta)
+		},
+		applied: func() (bool, error) {
+			trainer, err := trainersClient.GetTrainerByUsername(username)
+			if err != nil {
+				return false, wrapTradeCoinsError(err)
+			}
+
+			return trainer.Stats.Coins-balance == delta, nil
+		},
+	}
+}
+
+// addCoins keeps the rest of the stats as the trainers service has them and refuses to leave the
+// trainer with a negative balance
+func addCoins(trainersClient trainersService, username, authToken string, delta int) error {
+	trainer, err := trainersClient.GetTrainerByUsername(username)
+	if err != nil {
+		return wrapTradeCoinsError(err)
+	}
+
+	stats := trainer.Stats
+	if stats.Coins+delta < 0 {
+		return wrapTradeCoinsError(newNotEnoughCoinsError(username, -delta))
+	}
+
+	stats.Coins += delta
+	if _, err = trainersClient.UpdateTrainerStats(username, stats, authToken); err != nil {
+		return wrapTradeCoinsError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/NOVAPokemon/utils"
+	ws "github.com/NOVAPokemon/utils/websockets"
+)
+
+func TestOfferCoinsNeedsStatsTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		withStats []bool
+		giver     int
+		expected  errorCode
+	}{
+		{name: "both with stats", withStats: []bool{true, true}, giver: 0},
+		{name: "giver without stats", withStats: []bool{false, true}, giver: 0, expected: codeStatsTokenRequired},
+		{name: "recipient without stats", withStats: []bool{true, false}, giver: 0,
+			expected: codeStatsTokenRequired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lobby := newTestTradeLobby("coins")
+			lobby.withStats = test.withStats
+			info := ws.NewTrackedInfo(test.name)
+
+			answer := answerOf(lobby.handleOfferCoinsMessage(&info, &OfferCoinsMessage{Amount: 10},
+				lobby.status, test.giver))
+			if answer.Code != test.expected {
+				t.Errorf("offering coins answered %+v, expected code %q", answer, test.expected)
+			}
+
+			offered := lobby.status.Players[test.giver].Coins
+			if (test.expected == "") != (offered == 10) {
+				t.Errorf("%d coins offered after answering %+v", offered, answer)
+			}
+		})
+	}
+}
+
+func TestCoinsStepKeepsCoinsEarnedMeanwhile(t *testing.T) {
+	fakes := newFakeTrainers(map[string]*utils.Trainer{
+		"misty": {Stats: utils.TrainerStats{Level: 4, Coins: 20}},
+	}, fakeFaults{})
+	step := coinsStep(fakes, "misty", "", 20, -10)
+
+	// misty earns 5 coins after joining the trade, before it commits
+	fakes.trainers["misty"].Stats.Coins = 25
+	if err := step.apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	if coins := fakes.trainers["misty"].Stats.Coins; coins != 15 {
+		t.Errorf("misty has %d coins after giving 10, expected 15", coins)
+	}
+
+	// and 5 more before it is rolled back
+	fakes.trainers["misty"].Stats.Coins = 20
+	if err := step.compensate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if coins := fakes.trainers["misty"].Stats.Coins; coins != 30 {
+		t.Errorf("misty has %d coins after the rollback, expected 30", coins)
+	}
+}
+
+func TestCoinsStepNeverLeavesNegativeBalance(t *testing.T) {
+	fakes := newFakeTrainers(map[string]*utils.Trainer{
+		"misty": {Stats: utils.TrainerStats{Level: 4, Coins: 20}},
+	}, fakeFaults{})
+
+	// misty spends the coins elsewhere before the commit
+	fakes.trainers["misty"].Stats.Coins = 5
+	if err := coinsStep(fakes, "misty", "", 20, -10).apply(); err == nil {
+		t.Error("misty gave away 10 coins that were already spent")
+	}
+
+	if coins := fakes.trainers["misty"].Stats.Coins; coins != 5 {
+		t.Errorf("misty has %d coins, expected the 5 she had left", coins)
+	}
+}
@@ -0,0 +1,439 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	commitFailedInfo   = "trade could not be committed, nothing was exchanged"
+	rollbackFailedInfo = "trade could not be committed nor rolled back, contact support"
+)
+
+// commitStep is a single change applied to one trainer during a commit, paired with the
+// change that undoes it. applied inspects the trainer to tell whether the change is in place,
+// which makes compensating a step safe even when it is unknown if it went through.
+type commitStep struct {
+	description string
+	apply       func() error
+	compensate  func() error
+	applied     func() (bool, error)
+}
+
+// commitChanges applies a finished trade in two phases. The prepare phase checks that every
+// trainer still owns exactly the items, pokemons and coins they joined with. The apply phase
+// removes what every trainer offered before adding anything to the recipients, so a failure
+// never duplicates items, and compensates the steps already applied if any of them fails. Every
+// step is recorded in the journal before being applied so a crash mid-commit can be recovered
+// on startup.
+func commitChanges(trainersClient trainersService, lobby *tradeLobby) error {
+	entry := newJournalEntry(lobby)
+	authTokens := entry.AuthTokens
+	err := journal.Record(entry)
+	if err != nil {
+		return wrapCommitChangesError(err)
+	}
+
+	err = prepareCommit(trainersClient, lobby, authTokens)
+	if err != nil {
+		forgetJournalEntry(entry)
+		return wrapCommitChangesError(err)
+	}
+
+	if err = applyCommit(trainersClient, entry, authTokens); err != nil {
+		return wrapCommitChangesError(err)
+	}
+
+	for trainerNum, username := range lobby.trainers {
+		sendUpdatedTokens(trainersClient, lobby, trainerNum, username, authTokens[trainerNum])
+	}
+
+	log.Info("Changes committed")
+	return nil
+}
+
+// applyCommit runs the apply phase for an entry already recorded in the journal, rolling back
+// if any step fails. Auth tokens are given by trainer, in the order of the entry.
+func applyCommit(trainersClient trainersService, entry *journalEntry, authTokens []string) error {
+	steps := buildCommitSteps(trainersClient, entry, authTokens)
+	entry.State = journalApplying
+	for i, step := range steps {
+		entry.Started = i + 1
+		err := journal.Record(entry)
+		if err == nil {
+			err = step.apply()
+			auditStep(entry.LobbyId, step, err)
+		}
+
+		if err != nil {
+			log.Warnf("commit of %s failed on %s, rolling back", entry.LobbyId, step.description)
+			return rollbackCommit(entry, steps, err)
+		}
+	}
+
+	forgetJournalEntry(entry)
+	return nil
+}
+
+func prepareCommit(trainersClient trainersService, lobby *tradeLobby, authTokens []string) error {
+	for trainerNum, username := range lobby.trainers {
+		valid, err := trainersClient.VerifyItems(username, lobby.initialHashes[trainerNum], authTokens[trainerNum])
+		if err != nil {
+			return wrapPrepareCommitError(err)
+		}
+
+		if !*valid {
+			return wrapPrepareCommitError(newItemsChangedError(username))
+		}
+
+		if len(lobby.status.Players[trainerNum].Pokemons) == 0 {
+			continue
+		}
+
+		valid, err = trainersClient.VerifyPokemons(username, lobby.initialPokemonHashes[trainerNum],
+			authTokens[trainerNum])
+		if err != nil {
+			return wrapPrepareCommitError(err)
+		}
+
+		if !*valid {
+			return wrapPrepareCommitError(newPokemonsChangedError(username))
+		}
+	}
+
+	if !tradedCoins(lobby.status) {
+		return nil
+	}
+
+	// coins are only offered by and to trainers that joined with a stats token
+	for trainerNum, username := range lobby.trainers {
+		if !lobby.hasStats(trainerNum) {
+			continue
+		}
+
+		valid, err := trainersClient.VerifyTrainerStats(username, lobby.initialStatsHashes[trainerNum],
+			authTokens[trainerNum])
+		if err != nil {
+			return wrapPrepareCommitError(err)
+		}
+
+		if !*valid {
+			return wrapPrepareCommitError(newStatsChangedError(username))
+		}
+	}
+
+	return nil
+}
+
+// sendUpdatedTokens fetches the tokens of the assets the trade changed and sends them to the trainer
+func sendUpdatedTokens(trainersClient trainersService, lobby *tradeLobby, trainerNum int,
+	username, authToken string) {
+	if itemsToken, err := trainersClient.ItemsTokenFor(username, authToken); err != nil {
+		log.Error(wrapCommitChangesError(err))
+	} else {
+		lobby.sendTokensToUser([]string{itemsToken}, trainerNum)
+	}
+
+	if tradedCoins(lobby.status) && lobby.hasStats(trainerNum) {
+		if statsToken, err := trainersClient.StatsTokenFor(username, authToken); err != nil {
+			log.Error(wrapCommitChangesError(err))
+		} else {
+			lobby.sendTokensToUser([]string{statsToken}, trainerNum)
+		}
+	}
+
+	if !tradedPokemons(lobby.status) {
+		return
+	}
+
+	pokemonTokens, err := trainersClient.PokemonTokensFor(username, authToken)
+	if err != nil {
+		log.Error(wrapCommitChangesError(err))
+		return
+	}
+	lobby.sendTokensToUser(pokemonTokens, trainerNum)
+}
+
+// rollbackCommit undoes the steps started for the entry. The entry is only dropped from the
+// journal if everything was undone, otherwise it is left for recovery.
+func rollbackCommit(entry *journalEntry, steps []commitStep, cause error) error {
+	entry.State = journalRollingBack
+	if err := journal.Record(entry); err != nil {
+		log.Error(err)
+	}
+
+	rollbackErr := rollbackSteps(steps[:entry.Started])
+	auditRollback(entry.LobbyId, cause, rollbackErr)
+	if rollbackErr != nil {
+		return newRollbackFailedError(cause, rollbackErr)
+	}
+
+	forgetJournalEntry(entry)
+	return cause
+}
+
+func forgetJournalEntry(entry *journalEntry) {
+	if err := journal.Remove(entry.LobbyId); err != nil {
+		log.Error(err)
+	}
+}
+
+func buildCommitSteps(trainersClient trainersService, entry *journalEntry, authTokens []string) []commitStep {
+	var balances []int
+	if len(entry.Balances) > 0 {
+		balances = coinBalances(entry)
+	}
+
+	var steps []commitStep
+	for trainerNum, username := range entry.Trainers {
+		steps = append(steps, removeItemsStep(trainersClient, username, authTokens[trainerNum],
+			entry.Items[trainerNum]))
+		for _, pokemon := range entry.Pokemons[trainerNum] {
+			steps = append(steps, removePokemonStep(trainersClient, username, pokemon))
+		}
+		if balances != nil && balances[trainerNum] < entry.Balances[trainerNum] {
+			steps = append(steps, coinsStep(trainersClient, username, authTokens[trainerNum],
+				entry.Balances[trainerNum], balances[trainerNum]-entry.Balances[trainerNum]))
+		}
+	}
+
+	received := make([][]items.Item, len(entry.Trainers))
+	for giver, given := range entry.Items {
+		for _, item := range given {
+			recipient := transferRecipient(entry.Trainers, entry.ItemRecipients, giver, item.Id)
+			received[recipient] = append(received[recipient], item)
+		}
+	}
+
+	receivedPokemons := make([][]pokemons.Pokemon, len(entry.Trainers))
+	for giver, given := range entry.Pokemons {
+		for _, pokemon := range given {
+			recipient := transferRecipient(entry.Trainers, entry.PokemonRecipients, giver, pokemon.Id)
+			receivedPokemons[recipient] = append(receivedPokemons[recipient], pokemon)
+		}
+	}
+
+	for trainerNum, username := range entry.Trainers {
+		steps = append(steps, addItemsStep(trainersClient, username, authTokens[trainerNum],
+			received[trainerNum]))
+		for _, pokemon := range receivedPokemons[trainerNum] {
+			steps = append(steps, addPokemonStep(trainersClient, username, pokemon))
+		}
+		if balances != nil && balances[trainerNum] > entry.Balances[trainerNum] {
+			steps = append(steps, coinsStep(trainersClient, username, authTokens[trainerNum],
+				entry.Balances[trainerNum], balances[trainerNum]-entry.Balances[trainerNum]))
+		}
+	}
+
+	return steps
+}
+
+// transferRecipient finds the trainer receiving what giver offered with the given id. Without
+// recipients, as in trades between two trainers recorded before they existed, it goes to the
+// other trainer.
+func transferRecipient(trainers []string, recipients []map[string]string, giver int, id string) int {
+	if giver < len(recipients) {
+		if recipient, ok := recipients[giver][id]; ok {
+			for trainerNum, trainer := range trainers {
+				if trainer == recipient {
+					return trainerNum
+				}
+			}
+		}
+	}
+
+	return (giver + 1) % len(trainers)
+}
+
+func tradedPokemons(trade *tradeStatus) bool {
+	for _, player := range trade.Players {
+		if len(player.Pokemons) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeItemsStep(trainersClient trainersService, username, authToken string,
+	toRemove []items.Item) commitStep {
+	return commitStep{
+		description: "removing items from " + username,
+		apply: func() error {
+			return removeItems(trainersClient, username, authToken, toRemove)
+		},
+		compensate: func() error {
+			return addItems(trainersClient, username, authToken, toRemove)
+		},
+		applied: func() (bool, error) {
+			owns, err := ownsAnyItem(trainersClient, username, toRemove)
+			return !owns, err
+		},
+	}
+}
+
+func addItemsStep(trainersClient trainersService, username, authToken string,
+	toAdd []items.Item) commitStep {
+	return commitStep{
+		description: "adding items to " + username,
+		apply: func() error {
+			return addItems(trainersClient, username, authToken, toAdd)
+		},
+		compensate: func() error {
+			return removeItems(trainersClient, username, authToken, toAdd)
+		},
+		applied: func() (bool, error) {
+			if len(toAdd) == 0 {
+				return true, nil
+			}
+			return ownsAnyItem(trainersClient, username, toAdd)
+		},
+	}
+}
+
+func removePokemonStep(trainersClient trainersService, username string,
+	pokemon pokemons.Pokemon) commitStep {
+	return commitStep{
+		description: fmt.Sprintf("removing pokemon %s from %s", pokemon.Id, username),
+		apply: func() error {
+			return removePokemon(trainersClient, username, pokemon)
+		},
+		compensate: func() error {
+			return addPokemon(trainersClient, username, pokemon)
+		},
+		applied: func() (bool, error) {
+			owns, err := ownsPokemon(trainersClient, username, pokemon)
+			return !owns, err
+		},
+	}
+}
+
+func addPokemonStep(trainersClient trainersService, username string,
+	pokemon pokemons.Pokemon) commitStep {
+	return commitStep{
+		description: fmt.Sprintf("adding pokemon %s to %s", pokemon.Id, username),
+		apply: func() error {
+			return addPokemon(trainersClient, username, pokemon)
+		},
+		compensate: func() error {
+			return removePokemon(trainersClient, username, pokemon)
+		},
+		applied: func() (bool, error) {
+			return ownsPokemon(trainersClient, username, pokemon)
+		},
+	}
+}
+
+// rollbackSteps compensates the given steps that are applied, in reverse order. It keeps going
+// after a failed compensation so as much as possible is undone, and returns the first error found.
+func rollbackSteps(started []commitStep) error {
+	var firstErr error
+	for i := len(started) - 1; i >= 0; i-- {
+		applied, err := started[i].applied()
+		if err == nil && applied {
+			err = started[i].compensate()
+		}
+
+		if err != nil {
+			log.Errorf("failed compensating %s: %s", started[i].description, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+func ownsAnyItem(trainersClient trainersService, username string, toCheck []items.Item) (bool, error) {
+	if len(toCheck) == 0 {
+		return false, nil
+	}
+
+	trainer, err := trainersClient.GetTrainerByUsername(username)
+	if err != nil {
+		return false, wrapTradeItemsError(err)
+	}
+
+	for _, item := range toCheck {
+		if _, ok := trainer.Items[item.Id]; ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func removeItems(trainersClient trainersService, username, authToken string,
+	toRemove []items.Item) error {
+	if len(toRemove) == 0 {
+		return nil
+	}
+
+	toRemoveIds := make([]string, len(toRemove))
+	for i, item := range toRemove {
+		toRemoveIds[i] = item.Id
+	}
+
+	_, err := trainersClient.RemoveItems(username, toRemoveIds, authToken)
+	if err != nil {
+		return wrapTradeItemsError(err)
+	}
+
+	return nil
+}
+
+func addItems(trainersClient trainersService, username, authToken string, toAdd []items.Item) error {
+	if len(toAdd) == 0 {
+		return nil
+	}
+
+	_, err := trainersClient.AddItems(username, toAdd, authToken)
+	if err != nil {
+		return wrapTradeItemsError(err)
+	}
+
+	log.Info("items were successfully added")
+	return nil
+}
+
+func removePokemon(trainersClient trainersService, username string, pokemon pokemons.Pokemon) error {
+	err := trainersClient.RemovePokemonFromTrainer(username, pokemon.Id)
+	if err != nil {
+		return wrapTradePokemonsError(err)
+	}
+
+	return nil
+}
+
+func addPokemon(trainersClient trainersService, username string, pokemon pokemons.Pokemon) error {
+	_, err := trainersClient.AddPokemonToTrainer(username, pokemon)
+	if err != nil {
+		return wrapTradePokemonsError(err)
+	}
+
+	log.Infof("pokemon %s was successfully added", pokemon.Id)
+	return nil
+}
+
+func ownsPokemon(trainersClient trainersService, username string, pokemon pokemons.Pokemon) (bool, error) {
+	trainer, err := trainersClient.GetTrainerByUsername(username)
+	if err != nil {
+		return false, wrapTradePokemonsError(err)
+	}
+
+	_, ok := trainer.Pokemons[pokemon.Id]
+	return ok, nil
+}
+
+func commitFailure(err error) (errorCode, string) {
+	if errors.Cause(err) == errorRollbackFailed {
+		return codeRollbackFailed, rollbackFailedInfo
+	}
+
+	return codeCommitFailed, commitFailedInfo
+}
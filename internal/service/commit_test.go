@@ -0,0 +1,345 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	ws "github.com/NOVAPokemon/utils/websockets"
+)
+
+// failingTrainers fails the mutating call numbered failAt, counting from zero. With afterCall the
+// call goes through and only its response is lost.
+type failingTrainers struct {
+	trainersService
+	failAt    int
+	afterCall bool
+	calls     int
+}
+
+func (f *failingTrainers) mutate(method string, call func() error) error {
+	failing := f.calls == f.failAt
+	f.calls++
+
+	if !failing {
+		return call()
+	}
+
+	if f.afterCall {
+		if err := call(); err != nil {
+			return err
+		}
+	}
+
+	return newInjectedFailureError(method)
+}
+
+func (f *failingTrainers) RemoveItems(username string, itemIds []string,
+	authToken string) (removed map[string]items.Item, err error) {
+	err = f.mutate("RemoveItems", func() error {
+		removed, err = f.trainersService.RemoveItems(username, itemIds, authToken)
+		return err
+	})
+	return removed, err
+}
+
+func (f *failingTrainers) AddItems(username string, toAdd []items.Item,
+	authToken string) (added map[string]items.Item, err error) {
+	err = f.mutate("AddItems", func() error {
+		added, err = f.trainersService.AddItems(username, toAdd, authToken)
+		return err
+	})
+	return added, err
+}
+
+func (f *failingTrainers) AddPokemonToTrainer(username string, pokemon pokemons.Pokemon) (added *pokemons.Pokemon,
+	err error) {
+	err = f.mutate("AddPokemonToTrainer", func() error {
+		added, err = f.trainersService.AddPokemonToTrainer(username, pokemon)
+		return err
+	})
+	return added, err
+}
+
+func (f *failingTrainers) RemovePokemonFromTrainer(username, pokemonId string) error {
+	return f.mutate("RemovePokemonFromTrainer", func() error {
+		return f.trainersService.RemovePokemonFromTrainer(username, pokemonId)
+	})
+}
+
+func (f *failingTrainers) UpdateTrainerStats(username string, stats utils.TrainerStats,
+	authToken string) (updated *utils.TrainerStats, err error) {
+	err = f.mutate("UpdateTrainerStats", func() error {
+		updated, err = f.trainersService.UpdateTrainerStats(username, stats, authToken)
+		return err
+	})
+	return updated, err
+}
+
+// expectedCommitSteps are the steps of the trade in newCommitTestLobby, in the order they apply
+var expectedCommitSteps = []string{
+	"removing items from ash",
+	"removing pokemon ash-pikachu from ash",
+	"removing items from misty",
+	"taking 10 coins from misty",
+	"adding items to ash",
+	"adding 10 coins to ash",
+	"adding items to misty",
+	"adding pokemon ash-pikachu to misty",
+}
+
+// setupCommitTest uses a journal in a temporary directory and fake trainers owning what
+// newTestTradeLobby says they do. The returned function removes the journal.
+func setupCommitTest(t *testing.T) (*fakeTrainers, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if journal, err = newFileJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	audit = &memoryAudit{events: map[string][]*auditEvent{}}
+
+	return newFakeTrainers(map[string]*utils.Trainer{
+			"ash": {
+				Stats:    utils.TrainerStats{Level: 3, Coins: 50},
+				Items:    map[string]items.Item{"ash-potion": {Id: "ash-potion", Name: "potion"}},
+				Pokemons: map[string]pokemons.Pokemon{"ash-pikachu": {Id: "ash-pikachu", Species: "pikachu", Level: 5}},
+			},
+			"misty": {
+				Stats:    utils.TrainerStats{Level: 4, Coins: 20},
+				Items:    map[string]items.Item{"misty-pokeball": {Id: "misty-pokeball", Name: "pokeball"}},
+				Pokemons: map[string]pokemons.Pokemon{"misty-staryu": {Id: "misty-staryu", Species: "staryu", Level: 7}},
+			},
+		}, fakeFaults{}), func() {
+			_ = os.RemoveAll(dir)
+		}
+}
+
+// newCommitTestLobby is a finished trade in which ash gives a potion and pikachu to misty, who
+// gives a pokeball and 10 coins back
+func newCommitTestLobby(lobbyId string) *tradeLobby {
+	lobby := newTestTradeLobby(lobbyId)
+	for trainerNum := range lobby.trainers {
+		lobby.authTokens[trainerNum] = "token-" + lobby.trainers[trainerNum]
+		lobby.conns[trainerNum] = &trainerConn{
+			out:     make(chan *ws.WebsocketMsg, 10),
+			dropped: make(chan struct{}),
+		}
+	}
+
+	ash, misty := &lobby.status.Players[0], &lobby.status.Players[1]
+	ash.Items = []items.Item{lobby.availableItems[0]["ash-potion"]}
+	ash.Pokemons = []pokemons.Pokemon{lobby.availablePokemons[0]["ash-pikachu"]}
+	misty.Items = []items.Item{lobby.availableItems[1]["misty-pokeball"]}
+	misty.Coins = 10
+	lobby.status.TradeFinished = true
+	return lobby
+}
+
+// inventories has what every fake trainer owns
+func inventories(t *testing.T, fakes *fakeTrainers) map[string]*utils.Trainer {
+	t.Helper()
+
+	owned := map[string]*utils.Trainer{}
+	for _, username := range []string{"ash", "misty"} {
+		trainer, err := fakes.GetTrainerByUsername(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owned[username] = trainer
+	}
+
+	return owned
+}
+
+func expectNothingPending(t *testing.T) {
+	t.Helper()
+
+	entries, err := journal.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) > 0 {
+		t.Errorf("%d commits left in the journal", len(entries))
+	}
+}
+
+func TestBuildCommitSteps(t *testing.T) {
+	fakes, cleanup := setupCommitTest(t)
+	defer cleanup()
+	lobby := newCommitTestLobby("build-steps")
+
+	steps := buildCommitSteps(fakes, newJournalEntry(lobby), lobby.authTokens)
+
+	descriptions := make([]string, len(steps))
+	for i, step := range steps {
+		descriptions[i] = step.description
+	}
+
+	if !reflect.DeepEqual(descriptions, expectedCommitSteps) {
+		t.Errorf("built steps %q, expected %q", descriptions, expectedCommitSteps)
+	}
+}
+
+func TestCommitChanges(t *testing.T) {
+	fakes, cleanup := setupCommitTest(t)
+	defer cleanup()
+	lobby := newCommitTestLobby("commit")
+
+	if err := commitChanges(fakes, lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	owned := inventories(t, fakes)
+	ash, misty := owned["ash"], owned["misty"]
+	if _, ok := ash.Items["misty-pokeball"]; !ok || len(ash.Items) != 1 {
+		t.Errorf("ash owns items %v, expected only misty-pokeball", ash.Items)
+	}
+	if _, ok := misty.Items["ash-potion"]; !ok || len(misty.Items) != 1 {
+		t.Errorf("misty owns items %v, expected only ash-potion", misty.Items)
+	}
+	if _, ok := misty.Pokemons["ash-pikachu"]; !ok || len(ash.Pokemons) != 0 {
+		t.Error("pikachu did not go from ash to misty")
+	}
+	if ash.Stats.Coins != 60 || misty.Stats.Coins != 10 {
+		t.Errorf("ash has %d coins and misty %d, expected 60 and 10", ash.Stats.Coins, misty.Stats.Coins)
+	}
+
+	expectNothingPending(t)
+}
+
+func TestCommitChangesRollsBackFailedStep(t *testing.T) {
+	for failAt, description := range expectedCommitSteps {
+		for _, afterCall := range []bool{false, true} {
+			name := "before " + description
+			if afterCall {
+				name = "after " + description
+			}
+
+			t.Run(name, func(t *testing.T) {
+				fakes, cleanup := setupCommitTest(t)
+				defer cleanup()
+				original := inventories(t, fakes)
+				failing := &failingTrainers{trainersService: fakes, failAt: failAt, afterCall: afterCall}
+
+				err := commitChanges(failing, newCommitTestLobby("rollback"))
+				if err == nil {
+					t.Fatal("commit did not fail")
+				}
+
+				if code, _ := commitFailure(err); code != codeCommitFailed {
+					t.Errorf("commit failed with %s, expected %s: %s", code, codeCommitFailed, err)
+				}
+
+				if owned := inventories(t, fakes); !reflect.DeepEqual(owned, original) {
+					t.Errorf("rollback left %+v %+v, expected %+v %+v", *owned["ash"], *owned["misty"],
+						*original["ash"], *original["misty"])
+				}
+
+				expectNothingPending(t)
+			})
+		}
+	}
+}
+
+func TestRollbackSteps(t *testing.T) {
+	for applied := 0; applied <= len(expectedCommitSteps); applied++ {
+		t.Run(fmt.Sprintf("%d applied", applied), func(t *testing.T) {
+			fakes, cleanup := setupCommitTest(t)
+			defer cleanup()
+			original := inventories(t, fakes)
+			lobby := newCommitTestLobby("rollback-steps")
+			steps := buildCommitSteps(fakes, newJournalEntry(lobby), lobby.authTokens)
+
+			for _, step := range steps[:applied] {
+				if err := step.apply(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the step after the applied ones counts as started, as it would be after a crash
+			started := applied + 1
+			if started > len(steps) {
+				started = len(steps)
+			}
+
+			if err := rollbackSteps(steps[:started]); err != nil {
+				t.Fatal(err)
+			}
+
+			if owned := inventories(t, fakes); !reflect.DeepEqual(owned, original) {
+				t.Errorf("rollback left %+v %+v, expected %+v %+v", *owned["ash"], *owned["misty"],
+					*original["ash"], *original["misty"])
+			}
+		})
+	}
+}
+
+func TestRecoverTrade(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     journalState
+		applied   int
+		started   int
+		committed bool
+	}{
+		{name: "nothing applied", state: journalApplying, applied: 0, started: 1},
+		{name: "partially applied", state: journalApplying, applied: 3, started: 4},
+		{name: "last step lost", state: journalApplying, applied: 7, started: 8},
+		{name: "fully applied", state: journalApplying, applied: 8, started: 8, committed: true},
+		{name: "rolling back", state: journalRollingBack, applied: 5, started: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakes, cleanup := setupCommitTest(t)
+			defer cleanup()
+			original := inventories(t, fakes)
+			lobby := newCommitTestLobby("recover")
+
+			entry := newJournalEntry(lobby)
+			entry.State = test.state
+			entry.Started = test.started
+			if err := journal.Record(entry); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, step := range buildCommitSteps(fakes, entry, lobby.authTokens)[:test.applied] {
+				if err := step.apply(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			applied := inventories(t, fakes)
+
+			if err := recoverTrade(fakes, entry); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := original
+			if test.committed {
+				expected = applied
+			}
+
+			if owned := inventories(t, fakes); !reflect.DeepEqual(owned, expected) {
+				t.Errorf("recovery left %+v %+v, expected %+v %+v", *owned["ash"], *owned["misty"],
+					*expected["ash"], *expected["misty"])
+			}
+
+			if census := fakes.count(); census.coins != fakes.initial.coins {
+				t.Errorf("recovery left %d coins, started with %d", census.coins, fakes.initial.coins)
+			}
+
+			expectNothingPending(t)
+		})
+	}
+}
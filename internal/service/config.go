@@ -0,0 +1,288 @@
+package service
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	configFileEnvVar = "TRADES_CONFIG_FILE"
+
+	inviteTimeoutEnvVar        = "TRADES_INVITE_TIMEOUT"
+	inactivityTimeoutEnvVar    = "TRADES_INACTIVITY_TIMEOUT"
+	maxTradeDurationEnvVar     = "TRADES_MAX_TRADE_DURATION"
+	timeoutWarningEnvVar       = "TRADES_TIMEOUT_WARNING"
+	finishTimeoutEnvVar        = "TRADES_FINISH_TIMEOUT"
+	cleanupTimeoutEnvVar       = "TRADES_CLEANUP_TIMEOUT"
+	reconnectGraceEnvVar       = "TRADES_RECONNECT_GRACE"
+	offerTimeoutEnvVar         = "TRADES_OFFER_TIMEOUT"
+	maxItemsPerOfferEnvVar     = "TRADES_MAX_ITEMS_PER_OFFER"
+	maxLobbiesPerTrainerEnvVar = "TRADES_MAX_LOBBIES_PER_TRAINER"
+	maxViolationsEnvVar        = "TRADES_MAX_PROTOCOL_VIOLATIONS"
+	maxParticipantsEnvVar      = "TRADES_MAX_TRADE_PARTICIPANTS"
+	proxyJoinsEnvVar           = "TRADES_PROXY_JOINS"
+)
+
+// duration is a time.Duration read from and written to JSON as a string such as "30s"
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var durationString string
+	if err := json.Unmarshal(data, &durationString); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(durationString)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+type tradesConfig struct {
+	InviteTimeout         duration `json:"invite_timeout"`
+	InactivityTimeout     duration `json:"inactivity_timeout"`
+	MaxTradeDuration      duration `json:"max_trade_duration"`
+	TimeoutWarning        duration `json:"timeout_warning"`
+	FinishTimeout         duration `json:"finish_timeout"`
+	CleanupTimeout        duration `json:"cleanup_timeout"`
+	ReconnectGrace        duration `json:"reconnect_grace"`
+	OfferTimeout          duration `json:"offer_timeout"`
+	MaxItemsPerOffer      int      `json:"max_items_per_offer"`
+	MaxLobbiesPerTrainer  int      `json:"max_lobbies_per_trainer"`
+	MaxProtocolViolations int      `json:"max_protocol_violations"`
+	MaxTradeParticipants  int      `json:"max_trade_participants"`
+
+	// ProxyJoins forwards joins for lobbies owned by other replicas to them. It needs the mongo
+	// lobby store, since the memory one only knows the lobbies of its own replica.
+	ProxyJoins bool `json:"proxy_joins"`
+
+	Rules  tradeRules    `json:"rules"`
+	Values tradeValues   `json:"values"`
+	Chaos  chaosSettings `json:"chaos"`
+}
+
+var config = defaultConfig()
+
+// Flags are registered before utils.ParseFlags parses the command line and only override
+// the configuration when explicitly set.
+var (
+	configFileFlag           = flag.String("config", "", "path to the trades configuration file")
+	inviteTimeoutFlag        = flag.Duration("invite_timeout", 0, "time to wait for the invited trainer")
+	inactivityTimeoutFlag    = flag.Duration("inactivity_timeout", 0, "time a trade may go without messages")
+	maxTradeDurationFlag     = flag.Duration("max_trade_duration", 0, "maximum duration of a trade")
+	timeoutWarningFlag       = flag.Duration("timeout_warning", 0, "how long before a trade timeout to warn trainers")
+	finishTimeoutFlag        = flag.Duration("finish_timeout", 0, "time to wait for trainers to disconnect")
+	cleanupTimeoutFlag       = flag.Duration("cleanup_timeout", 0, "time to wait for a trainer when closing a lobby")
+	reconnectGraceFlag       = flag.Duration("reconnect_grace", 0, "time a disconnected trainer has to resume a trade")
+	offerTimeoutFlag         = flag.Duration("offer_timeout", 0, "time a trade offer can be answered in")
+	maxItemsPerOfferFlag     = flag.Int("max_items_per_offer", 0, "maximum items and pokemons in an offer")
+	maxLobbiesPerTrainerFlag = flag.Int("max_lobbies_per_trainer", 0, "maximum concurrent lobbies per trainer")
+	maxViolationsFlag        = flag.Int("max_protocol_violations", 0, "invalid messages tolerated per trainer")
+	maxParticipantsFlag      = flag.Int("max_trade_participants", 0, "maximum trainers in a single trade")
+	proxyJoinsFlag           = flag.Bool("proxy_joins", false, "proxy joins for lobbies of other replicas")
+)
+
+func defaultConfig() *tradesConfig {
+	return &tradesConfig{
+		InviteTimeout:         duration(30 * time.Second),
+		InactivityTimeout:     duration(2 * time.Minute),
+		MaxTradeDuration:      duration(10 * time.Minute),
+		TimeoutWarning:        duration(15 * time.Second),
+		FinishTimeout:         duration(3 * time.Second),
+		CleanupTimeout:        duration(5 * time.Second),
+		ReconnectGrace:        duration(30 * time.Second),
+		OfferTimeout:          duration(time.Hour),
+		MaxItemsPerOffer:      20,
+		MaxLobbiesPerTrainer:  3,
+		MaxProtocolViolations: 3,
+		MaxTradeParticipants:  4,
+		Values:                defaultTradeValues(),
+		Chaos:                 defaultChaosSettings(),
+	}
+}
+
+// loadConfig builds the configuration from the defaults, overridden by the config file, then by
+// environment variables and finally by flags. It must be called after the flags are parsed.
+func loadConfig() (*tradesConfig, error) {
+	loaded := defaultConfig()
+
+	configFile := *configFileFlag
+	if configFile == "" {
+		configFile = os.Getenv(configFileEnvVar)
+	}
+
+	if configFile != "" {
+		configBytes, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, wrapLoadConfigError(err)
+		}
+
+		if err = json.Unmarshal(configBytes, loaded); err != nil {
+			return nil, wrapLoadConfigError(err)
+		}
+	}
+
+	if err := loaded.loadFromEnv(); err != nil {
+		return nil, wrapLoadConfigError(err)
+	}
+
+	loaded.loadFromFlags()
+
+	if err := loaded.validate(); err != nil {
+		return nil, wrapLoadConfigError(err)
+	}
+
+	return loaded, nil
+}
+
+func (c *tradesConfig) loadFromEnv() error {
+	durations := map[string]*duration{
+		inviteTimeoutEnvVar:     &c.InviteTimeout,
+		inactivityTimeoutEnvVar: &c.InactivityTimeout,
+		maxTradeDurationEnvVar:  &c.MaxTradeDuration,
+		timeoutWarningEnvVar:    &c.TimeoutWarning,
+		finishTimeoutEnvVar:     &c.FinishTimeout,
+		cleanupTimeoutEnvVar:    &c.CleanupTimeout,
+		reconnectGraceEnvVar:    &c.ReconnectGrace,
+		offerTimeoutEnvVar:      &c.OfferTimeout,
+	}
+	for envVar, field := range durations {
+		value, exists := os.LookupEnv(envVar)
+		if !exists {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrap(err, envVar)
+		}
+		*field = duration(parsed)
+	}
+
+	ints := map[string]*int{
+		maxItemsPerOfferEnvVar:     &c.MaxItemsPerOffer,
+		maxLobbiesPerTrainerEnvVar: &c.MaxLobbiesPerTrainer,
+		maxViolationsEnvVar:        &c.MaxProtocolViolations,
+		maxParticipantsEnvVar:      &c.MaxTradeParticipants,
+	}
+	for envVar, field := range ints {
+		value, exists := os.LookupEnv(envVar)
+		if !exists {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.Wrap(err, envVar)
+		}
+		*field = parsed
+	}
+
+	if value, exists := os.LookupEnv(proxyJoinsEnvVar); exists {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Wrap(err, proxyJoinsEnvVar)
+		}
+		c.ProxyJoins = parsed
+	}
+
+	return nil
+}
+
+func (c *tradesConfig) loadFromFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "invite_timeout":
+			c.InviteTimeout = duration(*inviteTimeoutFlag)
+		case "inactivity_timeout":
+			c.InactivityTimeout = duration(*inactivityTimeoutFlag)
+		case "max_trade_duration":
+			c.MaxTradeDuration = duration(*maxTradeDurationFlag)
+		case "timeout_warning":
+			c.TimeoutWarning = duration(*timeoutWarningFlag)
+		case "finish_timeout":
+			c.FinishTimeout = duration(*finishTimeoutFlag)
+		case "cleanup_timeout":
+			c.CleanupTimeout = duration(*cleanupTimeoutFlag)
+		case "reconnect_grace":
+			c.ReconnectGrace = duration(*reconnectGraceFlag)
+		case "offer_timeout":
+			c.OfferTimeout = duration(*offerTimeoutFlag)
+		case "max_items_per_offer":
+			c.MaxItemsPerOffer = *maxItemsPerOfferFlag
+		case "max_lobbies_per_trainer":
+			c.MaxLobbiesPerTrainer = *maxLobbiesPerTrainerFlag
+		case "max_protocol_violations":
+			c.MaxProtocolViolations = *maxViolationsFlag
+		case "max_trade_participants":
+			c.MaxTradeParticipants = *maxParticipantsFlag
+		case "proxy_joins":
+			c.ProxyJoins = *proxyJoinsFlag
+		}
+	})
+}
+
+func (c *tradesConfig) validate() error {
+	durations := map[string]duration{
+		"invite_timeout":     c.InviteTimeout,
+		"inactivity_timeout": c.InactivityTimeout,
+		"max_trade_duration": c.MaxTradeDuration,
+		"timeout_warning":    c.TimeoutWarning,
+		"finish_timeout":     c.FinishTimeout,
+		"cleanup_timeout":    c.CleanupTimeout,
+		"reconnect_grace":    c.ReconnectGrace,
+		"offer_timeout":      c.OfferTimeout,
+	}
+	for name, value := range durations {
+		if value <= 0 {
+			return newInvalidConfigError(name, "must be positive")
+		}
+	}
+
+	if c.InactivityTimeout > c.MaxTradeDuration {
+		return newInvalidConfigError("inactivity_timeout", "must not exceed max_trade_duration")
+	}
+
+	if c.TimeoutWarning >= c.InactivityTimeout {
+		return newInvalidConfigError("timeout_warning", "must be shorter than inactivity_timeout")
+	}
+
+	if c.MaxItemsPerOffer < 1 {
+		return newInvalidConfigError("max_items_per_offer", "must be at least 1")
+	}
+
+	if c.MaxLobbiesPerTrainer < 1 {
+		return newInvalidConfigError("max_lobbies_per_trainer", "must be at least 1")
+	}
+
+	if c.MaxProtocolViolations < 1 {
+		return newInvalidConfigError("max_protocol_violations", "must be at least 1")
+	}
+
+	if c.MaxTradeParticipants < 2 {
+		return newInvalidConfigError("max_trade_participants", "must be at least 2")
+	}
+
+	if err := c.Rules.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Values.validate(); err != nil {
+		return err
+	}
+
+	return c.Chaos.validate()
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"sync"
+
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const resumedConnBuffer = 10
+
+// trainerConn is the connection a trainer plays a trade through. It starts as the one the
+// trainer joined the lobby with and is replaced by a new one when the trainer resumes the trade.
+// dropped is closed once the connection can no longer be used.
+type trainerConn struct {
+	in      chan *ws.WebsocketMsg
+	out     chan *ws.WebsocketMsg
+	dropped chan struct{}
+	close   func()
+}
+
+// trainerMessage is a message read from the connection of the trainer numbered trainerNum
+type trainerMessage struct {
+	trainerNum int
+	msg        *ws.WebsocketMsg
+}
+
+type droppedConn struct {
+	trainerNum int
+	conn       *trainerConn
+}
+
+// resumeRequest hands a new connection to the trade main loop, which answers on accepted
+type resumeRequest struct {
+	trainerNum int
+	conn       *trainerConn
+	accepted   chan bool
+}
+
+// newLobbyConn wraps the channels the ws lobby keeps for a trainer. Closing it is left to
+// ws.FinishLobby.
+func newLobbyConn(wsLobby *ws.Lobby, trainerNum int, finished <-chan struct{}) *trainerConn {
+	tc := &trainerConn{
+		in:      wsLobby.TrainerInChannels[trainerNum],
+		out:     wsLobby.TrainerOutChannels[trainerNum],
+		dropped: make(chan struct{}),
+		close:   func() {},
+	}
+
+	go func() {
+		select {
+		case <-wsLobby.DoneListeningFromConn[trainerNum]:
+		case <-wsLobby.DoneWritingToConn[trainerNum]:
+		case <-finished:
+			return
+		}
+		close(tc.dropped)
+	}()
+
+	return tc
+}
+
+// newResumedConn reads and writes the websocket a trainer reconnected with, in the same way the
+// ws lobby does for the connections it was created with.
+func newResumedConn(conn *websocket.Conn, manager ws.CommunicationManager) *trainerConn {
+	tc := &trainerConn{
+		in:      make(chan *ws.WebsocketMsg),
+		out:     make(chan *ws.WebsocketMsg, resumedConnBuffer),
+		dropped: make(chan struct{}),
+	}
+
+	closeOnce := sync.Once{}
+	tc.close = func() {
+		closeOnce.Do(func() {
+			close(tc.dropped)
+			if err := conn.Close(); err != nil {
+				log.Warn(wrapJoinTradeError(err))
+			}
+		})
+	}
+
+	go func() {
+		defer tc.close()
+		for {
+			msg, err := manager.ReadMessageFromConn(conn)
+			if err != nil {
+				return
+			}
+
+			select {
+			case tc.in <- msg:
+			case <-tc.dropped:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer tc.close()
+		for {
+			select {
+			case msg := <-tc.out:
+				if err := manager.WriteGenericMessageToConn(conn, msg); err != nil {
+					return
+				}
+			case <-tc.dropped:
+				return
+			}
+		}
+	}()
+
+	return tc
+}
+
+// send gives up on the message if the connection drops, so a lost trainer never blocks the trade
+func (tc *trainerConn) send(msg *ws.WebsocketMsg) {
+	select {
+	case tc.out <- msg:
+	case <-tc.dropped:
+	}
+}
+
+// resume hands conn to the main loop of an ongoing trade. It fails if the trainer is not
+// disconnected or the trade is already over.
+func (lobby *tradeLobby) resume(trainerNum int, conn *trainerConn) bool {
+	request := resumeRequest{
+		trainerNum: trainerNum,
+		conn:       conn,
+		accepted:   make(chan bool, 1),
+	}
+
+	select {
+	case lobby.resumes <- request:
+	case <-lobby.finished:
+		return false
+	}
+
+	select {
+	case accepted := <-request.accepted:
+		return accepted
+	case <-lobby.finished:
+		return false
+	}
+}
+
+// watch forwards what the trainer sends to the trade main loop and reports when the connection
+// drops, until the trade finishes
+func (lobby *tradeLobby) watch(trainerNum int, conn *trainerConn) {
+	go func() {
+		in := conn.in
+		for {
+			select {
+			case msg, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+
+				select {
+				case lobby.incoming <- trainerMessage{trainerNum: trainerNum, msg: msg}:
+				case <-lobby.finished:
+					return
+				}
+			case <-conn.dropped:
+				select {
+				case lobby.drops <- droppedConn{trainerNum: trainerNum, conn: conn}:
+				case <-lobby.finished:
+				}
+				return
+			case <-lobby.finished:
+				return
+			}
+		}
+	}()
+}
+
+func (lobby *tradeLobby) sendTo(msg *ws.WebsocketMsg, trainerNums ...int) {
+	for _, trainerNum := range trainerNums {
+		lobby.conns[trainerNum].send(msg)
+	}
+}
+
+func (lobby *tradeLobby) sendToAll(msg *ws.WebsocketMsg) {
+	for _, conn := range lobby.conns {
+		conn.send(msg)
+	}
+}
+
+// others are every trainer in the trade but the given one
+func (lobby *tradeLobby) others(trainerNum int) []int {
+	others := make([]int, 0, len(lobby.conns)-1)
+	for i := range lobby.conns {
+		if i != trainerNum {
+			others = append(others, i)
+		}
+	}
+
+	return others
+}
+
+// closeConns stops watching the lobby connections and closes the resumed ones
+func (lobby *tradeLobby) closeConns() {
+	lobby.finishOnce.Do(func() {
+		close(lobby.finished)
+	})
+
+	for _, conn := range lobby.conns {
+		if conn != nil {
+			conn.close()
+		}
+	}
+}
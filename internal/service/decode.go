@@ -0,0 +1,50 @@
+package service
+
+import (
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// decodeMessageData decodes the data of a client message into target, failing on fields target
+// does not have and on any of the required ids left empty once decoded.
+func decodeMessageData(data interface{}, target interface{}, requiredIds ...*string) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused: true,
+		Result:      target,
+	})
+	if err != nil {
+		return wrapDecodeMessageError(err)
+	}
+
+	if err = decoder.Decode(data); err != nil {
+		return wrapDecodeMessageError(err)
+	}
+
+	for _, id := range requiredIds {
+		if *id == "" {
+			return wrapDecodeMessageError(errorMissingId)
+		}
+	}
+
+	return nil
+}
+
+// protocolViolation counts a strike against the trainer and builds the error sent back. The error
+// is fatal when the trainer reaches the maximum violations, after which the trade is aborted.
+func (lobby *tradeLobby) protocolViolation(trackInfo ws.TrackedInfo, trainerNum int, code errorCode,
+	err error) *ws.WebsocketMsg {
+	lobby.strikes[trainerNum]++
+	log.Warnf("protocol violation %d by %s in lobby %s: %s", lobby.strikes[trainerNum],
+		lobby.trainers[trainerNum], lobby.wsLobby.Id, err)
+
+	return ErrorTradeMessage{
+		Code:  code,
+		Info:  err.Error(),
+		Fatal: lobby.exceededViolations(trainerNum),
+	}.ConvertToWSMessage(trackInfo)
+}
+
+func (lobby *tradeLobby) exceededViolations(trainerNum int) bool {
+	return lobby.strikes[trainerNum] >= config.MaxProtocolViolations
+}
@@ -0,0 +1,420 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// errorCode identifies errors sent to clients, both in websocket messages and HTTP responses
+type errorCode string
+
+const (
+	codeItemNotOwned          errorCode = "ITEM_NOT_OWNED"
+	codeItemAlreadyOffered    errorCode = "ITEM_ALREADY_OFFERED"
+	codeItemNotOffered        errorCode = "ITEM_NOT_OFFERED"
+	codeItemInEscrow          errorCode = "ITEM_IN_ESCROW"
+	codePokemonNotOwned       errorCode = "POKEMON_NOT_OWNED"
+	codePokemonAlreadyOffered errorCode = "POKEMON_ALREADY_OFFERED"
+	codePokemonNotOffered     errorCode = "POKEMON_NOT_OFFERED"
+	codePokemonInEscrow       errorCode = "POKEMON_IN_ESCROW"
+	codeOfferTooLarge         errorCode = "OFFER_TOO_LARGE"
+	codeInvalidCoins          errorCode = "INVALID_COINS"
+	codeNotEnoughCoins        errorCode = "NOT_ENOUGH_COINS"
+	codeStatsTokenRequired    errorCode = "STATS_TOKEN_REQUIRED"
+	codeTradeRuleViolated     errorCode = "TRADE_RULE_VIOLATED"
+	codeNothingToConfirm      errorCode = "NOTHING_TO_CONFIRM"
+	codeInvalidMessage        errorCode = "INVALID_MESSAGE"
+	codeUnknownMessageType    errorCode = "UNKNOWN_MESSAGE_TYPE"
+	codeProtocolViolations    errorCode = "PROTOCOL_VIOLATIONS"
+	codeLobbyExpired          errorCode = "LOBBY_EXPIRED"
+	codeTradeInactive         errorCode = "TRADE_INACTIVE"
+	codeTradeExpired          errorCode = "TRADE_EXPIRED"
+	codeTrainerDisconnected   errorCode = "TRAINER_DISCONNECTED"
+	codeCommitFailed          errorCode = "COMMIT_FAILED"
+	codeRollbackFailed        errorCode = "ROLLBACK_FAILED"
+	codeLobbyNotFound         errorCode = "LOBBY_NOT_FOUND"
+	codePlayerNotExpected     errorCode = "PLAYER_NOT_EXPECTED"
+	codeInvalidLobbyId        errorCode = "INVALID_LOBBY_ID"
+	codeTooManyLobbies        errorCode = "TOO_MANY_LOBBIES"
+	codeInvalidRecipient      errorCode = "INVALID_RECIPIENT"
+	codeRequestNotFound       errorCode = "REQUEST_NOT_FOUND"
+	codeRequestNotPending     errorCode = "REQUEST_NOT_PENDING"
+	codeRequestAlreadyMade    errorCode = "REQUEST_ALREADY_MADE"
+	codeOfferNotFound         errorCode = "OFFER_NOT_FOUND"
+	codeOfferNotPending       errorCode = "OFFER_NOT_PENDING"
+	codeOfferExpired          errorCode = "OFFER_EXPIRED"
+	codeOfferNotGranted       errorCode = "OFFER_NOT_GRANTED"
+	codeBadRequest            errorCode = "BAD_REQUEST"
+	codeUnauthorized          errorCode = "UNAUTHORIZED"
+	codeForbidden             errorCode = "FORBIDDEN"
+	codeInternalError         errorCode = "INTERNAL_ERROR"
+)
+
+const (
+	errorTradeItems    = "error trading items"
+	errorTradePokemons = "error trading pokemons"
+	errorTradeCoins    = "error trading coins"
+	errorCommitChanges = "error commiting changes"
+	errorPrepareCommit = "error preparing commit"
+	errorJournal       = "error in trade journal"
+	errorRecoverTrades = "error recovering trades"
+	errorLobbyStore    = "error in lobby store"
+	errorProxyJoin     = "error proxying join to lobby owner"
+	errorTradeHistory  = "error in trade history"
+	errorAuditLog      = "error in audit log"
+	errorReplay        = "error replaying trade"
+	errorLoad          = "error generating load"
+	errorLoadConfig    = "error loading configuration"
+	errorStatus        = "error in status"
+	errorDecodeMessage = "error decoding message"
+	errorOfferStore    = "error in offer store"
+	errorNotifyOffer   = "error notifying trade offer"
+	errorAccounts      = "error in account registry"
+
+	errorTradeLobbyNotFoundFormat  = "trade lobby %s not found"
+	errorPlayerNotExpectedFormat   = "player %s not expected in lobby"
+	errorPlayerJoinedFormat        = "player %s already joined the lobby"
+	errorInvalidParticipantsFormat = "invalid trade participants: %s"
+	errorItemsChangedFormat        = "items of %s changed since joining the trade"
+	errorPokemonsChangedFormat     = "pokemons of %s changed since joining the trade"
+	errorStatsChangedFormat        = "stats of %s changed since joining the trade"
+	errorRollbackFailedFormat      = "commit failed with %s and rollback failed with %s"
+	errorInvalidJournalFormat      = "invalid journal backend %s"
+	errorInvalidLobbyStoreFormat   = "invalid lobby store %s"
+	errorInvalidHistoryFormat      = "invalid history store %s"
+	errorInvalidAuditFormat        = "invalid audit store %s"
+	errorInvalidAccountStoreFormat = "invalid account store %s"
+	errorInvalidOutcomeFormat      = "invalid trade outcome %s"
+	errorHistoryForbiddenFormat    = "%s can not see the trade history of %s"
+	errorInvalidConfigFormat       = "invalid configuration %s: %s"
+	errorTooManyLobbiesFormat      = "trainer %s is in too many lobbies"
+	errorInvalidMessageTypeFormat  = "invalid msg type %s"
+	errorCannotResumeFormat        = "trainer %s can not resume trade %s"
+	errorInvalidOfferStoreFormat   = "invalid offer store %s"
+	errorInvalidOfferFormat        = "invalid trade offer: %s"
+	errorOfferNotFoundFormat       = "trade offer %s not found"
+	errorNotEnoughCoinsFormat      = "%s does not have %d coins to give"
+	errorOfferForbiddenFormat      = "%s can not answer trade offer %s"
+	errorOfferNotPendingFormat     = "trade offer %s is %s"
+	errorOfferInEscrowFormat       = "trade offer %s exchanges items offered in another trade"
+	errorOfferNotGrantedFormat     = "the sender of trade offer %s has to make it again to authorize it"
+	errorItemNotOwnedFormat        = "item %s not owned"
+	errorPokemonNotOwnedFormat     = "pokemon %s not owned"
+	errorRuleViolatedFormat        = "trade rule violated: %s"
+	errorInjectedFailureFormat     = "injected failure in %s"
+	errorFakeTrainerNotFoundFormat = "fake trainer %s not found"
+	errorNotEnoughTrainersFormat   = "load needs %d trainers but only %d were given"
+)
+
+var (
+	errorNoTradeId = errors.New("no trade id provided")
+	errorInvalidId = errors.New("invalid trade id provided")
+
+	errorInvalidPokemonTokens = errors.New("invalid pokemon tokens")
+	errorNoMongoURL           = errors.New("no mongodb url in environment")
+
+	errorProxyNeedsSharedStore = errors.New("proxying joins needs the mongo lobby store")
+
+	errorLobbyExpired  = errors.New("invited trainer did not join in time")
+	errorTradeInactive = errors.New("trade aborted due to inactivity")
+	errorTradeExpired  = errors.New("trade aborted for exceeding its maximum duration")
+
+	errorTrainerDisconnected = errors.New("trainer did not reconnect in time")
+
+	errorMissingTrackInfo  = errors.New("message without tracking info")
+	errorMissingId         = errors.New("message without required id")
+	errorTooManyViolations = errors.New("trade aborted after too many protocol violations")
+
+	errorRollbackFailed = errors.New("error rolling back commit")
+
+	errorAuditForbidden = errors.New("only support can export the audit log")
+
+	errorNoTradeStarted  = errors.New("audit log has no trade start")
+	errorInvalidSnapshot = errors.New("invalid trade start in audit log")
+	errorReplayDiverged  = errors.New("replay diverged from the recorded trade")
+
+	errorChaosKilledConn = errors.New("connection killed by chaos mode")
+)
+
+type httpErrorBody struct {
+	Code    errorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// HTTP error responses carrying an error code, in the manner of utils.LogAndSendHTTPError
+func logAndSendHTTPError(w http.ResponseWriter, err error, code errorCode, status int) {
+	log.Error(err)
+	sendHTTPError(w, err, code, status)
+}
+
+func logWarnAndSendHTTPError(w http.ResponseWriter, err error, code errorCode, status int) {
+	log.Warn(err)
+	sendHTTPError(w, err, code, status)
+}
+
+func sendHTTPError(w http.ResponseWriter, err error, code errorCode, status int) {
+	body, marshalErr := json.Marshal(httpErrorBody{
+		Code:    code,
+		Message: err.Error(),
+	})
+	if marshalErr != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// Handler wrappers
+func wrapGetLobbiesError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, getLobbiesName))
+}
+
+func wrapCreateTradeError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, createTradeName))
+}
+
+func wrapJoinTradeError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, joinTradeName))
+}
+
+func wrapRejectTradeError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, rejectTradeName))
+}
+
+func wrapGetTradeHistoryError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, tradeHistoryName))
+}
+
+func wrapGetTradeAuditError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, tradeAuditName))
+}
+
+func wrapCreateOfferError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, createTradeOfferName))
+}
+
+func wrapGetOffersError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, getTradeOffersName))
+}
+
+func wrapAnswerOfferError(err error) error {
+	return errors.Wrap(err, fmt.Sprintf(utils.ErrorInHandlerFormat, answerTradeOfferName))
+}
+
+// Other wrappers
+func wrapTradeItemsError(err error) error {
+	return errors.Wrap(err, errorTradeItems)
+}
+
+func wrapTradePokemonsError(err error) error {
+	return errors.Wrap(err, errorTradePokemons)
+}
+
+func wrapTradeCoinsError(err error) error {
+	return errors.Wrap(err, errorTradeCoins)
+}
+
+func wrapCommitChangesError(err error) error {
+	return errors.Wrap(err, errorCommitChanges)
+}
+
+func wrapPrepareCommitError(err error) error {
+	return errors.Wrap(err, errorPrepareCommit)
+}
+
+func wrapJournalError(err error) error {
+	return errors.Wrap(err, errorJournal)
+}
+
+func wrapRecoverTradesError(err error) error {
+	return errors.Wrap(err, errorRecoverTrades)
+}
+
+func wrapLobbyStoreError(err error) error {
+	return errors.Wrap(err, errorLobbyStore)
+}
+
+func wrapProxyJoinError(err error) error {
+	return errors.Wrap(err, errorProxyJoin)
+}
+
+func wrapTradeHistoryError(err error) error {
+	return errors.Wrap(err, errorTradeHistory)
+}
+
+func wrapAccountRegistryError(err error) error {
+	return errors.Wrap(err, errorAccounts)
+}
+
+func wrapAuditLogError(err error) error {
+	return errors.Wrap(err, errorAuditLog)
+}
+
+func wrapReplayError(err error) error {
+	return errors.Wrap(err, errorReplay)
+}
+
+func wrapLoadError(err error) error {
+	return errors.Wrap(err, errorLoad)
+}
+
+func wrapLoadConfigError(err error) error {
+	return errors.Wrap(err, errorLoadConfig)
+}
+
+func wrapStatusError(err error) error {
+	return errors.Wrap(err, errorStatus)
+}
+
+func wrapDecodeMessageError(err error) error {
+	return errors.Wrap(err, errorDecodeMessage)
+}
+
+func wrapOfferStoreError(err error) error {
+	return errors.Wrap(err, errorOfferStore)
+}
+
+func wrapNotifyOfferError(err error) error {
+	return errors.Wrap(err, errorNotifyOffer)
+}
+
+// Error builders
+func newTradeLobbyNotFoundError(lobbyId string) error {
+	return errors.New(fmt.Sprintf(errorTradeLobbyNotFoundFormat, lobbyId))
+}
+
+func newPlayerNotExpectedError(username string) error {
+	return errors.New(fmt.Sprintf(errorPlayerNotExpectedFormat, username))
+}
+
+func newPlayerAlreadyJoinedError(username string) error {
+	return errors.New(fmt.Sprintf(errorPlayerJoinedFormat, username))
+}
+
+func newInvalidParticipantsError(reason string) error {
+	return errors.New(fmt.Sprintf(errorInvalidParticipantsFormat, reason))
+}
+
+func newCannotResumeError(username, lobbyId string) error {
+	return errors.New(fmt.Sprintf(errorCannotResumeFormat, username, lobbyId))
+}
+
+func newItemsChangedError(username string) error {
+	return errors.New(fmt.Sprintf(errorItemsChangedFormat, username))
+}
+
+func newPokemonsChangedError(username string) error {
+	return errors.New(fmt.Sprintf(errorPokemonsChangedFormat, username))
+}
+
+func newStatsChangedError(username string) error {
+	return errors.New(fmt.Sprintf(errorStatsChangedFormat, username))
+}
+
+func newRuleViolatedError(reason string) error {
+	return errors.New(fmt.Sprintf(errorRuleViolatedFormat, reason))
+}
+
+func newRollbackFailedError(commitErr, rollbackErr error) error {
+	return errors.Wrap(errorRollbackFailed, fmt.Sprintf(errorRollbackFailedFormat, commitErr, rollbackErr))
+}
+
+func newInvalidJournalBackendError(backend string) error {
+	return errors.New(fmt.Sprintf(errorInvalidJournalFormat, backend))
+}
+
+func newNotEnoughCoinsError(username string, coins int) error {
+	return errors.New(fmt.Sprintf(errorNotEnoughCoinsFormat, username, coins))
+}
+
+func newInvalidLobbyStoreError(storeType string) error {
+	return errors.New(fmt.Sprintf(errorInvalidLobbyStoreFormat, storeType))
+}
+
+func newInvalidHistoryStoreError(storeType string) error {
+	return errors.New(fmt.Sprintf(errorInvalidHistoryFormat, storeType))
+}
+
+func newInvalidAccountStoreError(storeType string) error {
+	return errors.New(fmt.Sprintf(errorInvalidAccountStoreFormat, storeType))
+}
+
+func newInvalidAuditStoreError(storeType string) error {
+	return errors.New(fmt.Sprintf(errorInvalidAuditFormat, storeType))
+}
+
+func newInvalidOutcomeError(outcome string) error {
+	return errors.New(fmt.Sprintf(errorInvalidOutcomeFormat, outcome))
+}
+
+func newHistoryForbiddenError(username, owner string) error {
+	return errors.New(fmt.Sprintf(errorHistoryForbiddenFormat, username, owner))
+}
+
+func newInvalidConfigError(name, reason string) error {
+	return errors.New(fmt.Sprintf(errorInvalidConfigFormat, name, reason))
+}
+
+func newTooManyLobbiesError(username string) error {
+	return errors.New(fmt.Sprintf(errorTooManyLobbiesFormat, username))
+}
+
+func newInvalidMessageTypeError(msgType string) error {
+	return errors.New(fmt.Sprintf(errorInvalidMessageTypeFormat, msgType))
+}
+
+func newInvalidOfferStoreError(storeType string) error {
+	return errors.New(fmt.Sprintf(errorInvalidOfferStoreFormat, storeType))
+}
+
+func newInvalidOfferError(reason string) error {
+	return errors.New(fmt.Sprintf(errorInvalidOfferFormat, reason))
+}
+
+func newOfferNotFoundError(offerId string) error {
+	return errors.New(fmt.Sprintf(errorOfferNotFoundFormat, offerId))
+}
+
+func newOfferForbiddenError(username, offerId string) error {
+	return errors.New(fmt.Sprintf(errorOfferForbiddenFormat, username, offerId))
+}
+
+func newOfferNotPendingError(offerId string, state offerState) error {
+	return errors.New(fmt.Sprintf(errorOfferNotPendingFormat, offerId, state))
+}
+
+func newOfferInEscrowError(offerId string) error {
+	return errors.New(fmt.Sprintf(errorOfferInEscrowFormat, offerId))
+}
+
+func newOfferNotGrantedError(offerId string) error {
+	return errors.New(fmt.Sprintf(errorOfferNotGrantedFormat, offerId))
+}
+
+func newItemNotOwnedError(itemId string) error {
+	return errors.New(fmt.Sprintf(errorItemNotOwnedFormat, itemId))
+}
+
+func newPokemonNotOwnedError(pokemonId string) error {
+	return errors.New(fmt.Sprintf(errorPokemonNotOwnedFormat, pokemonId))
+}
+
+func newInjectedFailureError(method string) error {
+	return errors.New(fmt.Sprintf(errorInjectedFailureFormat, method))
+}
+
+func newFakeTrainerNotFoundError(username string) error {
+	return errors.New(fmt.Sprintf(errorFakeTrainerNotFoundFormat, username))
+}
+
+func newNotEnoughTrainersError(given, needed int) error {
+	return errors.New(fmt.Sprintf(errorNotEnoughTrainersFormat, needed, given))
+}
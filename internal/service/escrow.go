@@ -0,0 +1,76 @@
+package service
+
+import (
+	"sync"
+)
+
+type escrowKind string
+
+const (
+	escrowItem    escrowKind = "item"
+	escrowPokemon escrowKind = "pokemon"
+)
+
+type escrowKey struct {
+	username string
+	kind     escrowKind
+	id       string
+}
+
+// tradeEscrow locks what trainers put in an offer to the lobby it was offered in, so the same
+// item or pokemon can not be offered in two trades at once. Locks are held until the offer is
+// withdrawn or the trade ends, however it ends.
+//
+// The locks only live in this process. They do not stop the trainer from using or selling the
+// item or pokemon through other services, nor from offering it in a lobby of another replica.
+// Those cases are still caught when committing, by the checks that inventories did not change
+// since joining the trade.
+type tradeEscrow struct {
+	locks map[escrowKey]string
+	lock  sync.Mutex
+}
+
+var escrow = newTradeEscrow()
+
+func newTradeEscrow() *tradeEscrow {
+	return &tradeEscrow{
+		locks: map[escrowKey]string{},
+	}
+}
+
+// Lock fails if the trainer already offered it in another lobby
+func (e *tradeEscrow) Lock(lobbyId, username string, kind escrowKind, id string) bool {
+	key := escrowKey{username: username, kind: kind, id: id}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if holder, locked := e.locks[key]; locked && holder != lobbyId {
+		return false
+	}
+
+	e.locks[key] = lobbyId
+	return true
+}
+
+func (e *tradeEscrow) Release(lobbyId, username string, kind escrowKind, id string) {
+	key := escrowKey{username: username, kind: kind, id: id}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.locks[key] == lobbyId {
+		delete(e.locks, key)
+	}
+}
+
+func (e *tradeEscrow) ReleaseLobby(lobbyId string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for key, holder := range e.locks {
+		if holder == lobbyId {
+			delete(e.locks, key)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	"github.com/NOVAPokemon/utils/tokens"
+	notificationMessages "github.com/NOVAPokemon/utils/websockets/notifications"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	fakeServicesEnvVar     = "TRADES_FAKE_SERVICES"
+	fakeTrainersFileEnvVar = "TRADES_FAKE_TRAINERS_FILE"
+	fakeLatencyEnvVar      = "TRADES_FAKE_LATENCY"
+	fakeFailuresEnvVar     = "TRADES_FAKE_FAILURES"
+)
+
+// fake tokens are these prefixes followed by the username, or by the id for pokemon tokens
+const (
+	fakeAuthTokenPrefix    = "fake-auth-token-"
+	fakeItemsTokenPrefix   = "fake-items-token-"
+	fakePokemonTokenPrefix = "fake-pokemon-token-"
+	fakeStatsTokenPrefix   = "fake-stats-token-"
+)
+
+// fakeFaults make fake services slower or fail on purpose. Failures are given by method name, as
+// in AddItems, and make every call to that method fail.
+type fakeFaults struct {
+	latency  time.Duration
+	failures []string
+}
+
+func (faults fakeFaults) call(method string) error {
+	time.Sleep(faults.latency)
+
+	if contains(faults.failures, method) {
+		return newInjectedFailureError(method)
+	}
+
+	return nil
+}
+
+// useFakeServicesFromEnv replaces the trainers and notifications services with in-process fakes,
+// so the service can run without them, and returns the fake trainers. Trainers are read from a
+// JSON file mapping usernames to trainers. Requests then carry the fake tokens of fakeTokens.
+func useFakeServicesFromEnv() (*fakeTrainers, error) {
+	if os.Getenv(fakeServicesEnvVar) != "true" {
+		return nil, nil
+	}
+
+	faults := fakeFaults{}
+	if latencyString, exists := os.LookupEnv(fakeLatencyEnvVar); exists {
+		latency, err := time.ParseDuration(latencyString)
+		if err != nil {
+			return nil, newInvalidConfigError(fakeLatencyEnvVar, err.Error())
+		}
+		faults.latency = latency
+	}
+
+	if failuresString, exists := os.LookupEnv(fakeFailuresEnvVar); exists && failuresString != "" {
+		faults.failures = strings.Split(failuresString, ",")
+	}
+
+	trainers := map[string]*utils.Trainer{}
+	if trainersFile, exists := os.LookupEnv(fakeTrainersFileEnvVar); exists {
+		trainersBytes, err := ioutil.ReadFile(trainersFile)
+		if err != nil {
+			return nil, newInvalidConfigError(fakeTrainersFileEnvVar, err.Error())
+		}
+
+		if err = json.Unmarshal(trainersBytes, &trainers); err != nil {
+			return nil, newInvalidConfigError(fakeTrainersFileEnvVar, err.Error())
+		}
+	}
+
+	fakes := newFakeTrainers(trainers, faults)
+	useFakeServices(fakes)
+
+	return fakes, nil
+}
+
+func useFakeServices(fakes *fakeTrainers) {
+	newTrainersClient = func() trainersService {
+		return fakes
+	}
+	notificationsClient = &fakeNotifications{faults: fakes.faults}
+	verifier = fakeTokens{fakes: fakes}
+}
+
+// fakeTrainers keeps trainers in memory and is shared by every request, unlike the clients of the
+// trainers service. Hashes and tokens are only made up, so anything the fake is asked to verify
+// is valid as long as the trainer exists.
+type fakeTrainers struct {
+	trainers map[string]*utils.Trainer
+	initial  fakeCensus
+	faults   fakeFaults
+	lock     sync.Mutex
+}
+
+// fakeCensus counts the trainers owning each item and pokemon, by id, and the coins of all of them
+type fakeCensus struct {
+	owners map[string]int
+	coins  int
+}
+
+func newFakeTrainers(trainers map[string]*utils.Trainer, faults fakeFaults) *fakeTrainers {
+	for username, trainer := range trainers {
+		trainer.Username = username
+		if trainer.Items == nil {
+			trainer.Items = map[string]items.Item{}
+		}
+		if trainer.Pokemons == nil {
+			trainer.Pokemons = map[string]pokemons.Pokemon{}
+		}
+	}
+
+	fakes := &fakeTrainers{trainers: trainers, faults: faults}
+	fakes.initial = fakes.count()
+	return fakes
+}
+
+// census counts what the trainers own, unless busy says they may be in the middle of a commit.
+// busy is asked holding the lock, so nothing changes between asking and counting.
+func (f *fakeTrainers) census(busy func() bool) (fakeCensus, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if busy() {
+		return fakeCensus{}, false
+	}
+
+	return f.count(), true
+}
+
+// count must be called holding the lock, unless the fakes are not in use yet
+func (f *fakeTrainers) count() fakeCensus {
+	census := fakeCensus{owners: map[string]int{}}
+	for _, trainer := range f.trainers {
+		for itemId := range trainer.Items {
+			census.owners[itemId]++
+		}
+		for pokemonId := range trainer.Pokemons {
+			census.owners[pokemonId]++
+		}
+		census.coins += trainer.Stats.Coins
+	}
+
+	return census
+}
+
+// pokemon must be called holding the lock
+func (f *fakeTrainers) pokemon(pokemonId string) (pokemons.Pokemon, bool) {
+	for _, trainer := range f.trainers {
+		if pokemon, ok := trainer.Pokemons[pokemonId]; ok {
+			return pokemon, true
+		}
+	}
+
+	return pokemons.Pokemon{}, false
+}
+
+// trainer must be called holding the lock
+func (f *fakeTrainers) trainer(username string) (*utils.Trainer, error) {
+	trainer, ok := f.trainers[username]
+	if !ok {
+		return nil, newFakeTrainerNotFoundError(username)
+	}
+
+	return trainer, nil
+}
+
+func (f *fakeTrainers) GetTrainerByUsername(username string) (*utils.Trainer, error) {
+	if err := f.faults.call("GetTrainerByUsername"); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	trainerCopy := *trainer
+	trainerCopy.Items = make(map[string]items.Item, len(trainer.Items))
+	for itemId, item := range trainer.Items {
+		trainerCopy.Items[itemId] = item
+	}
+	trainerCopy.Pokemons = make(map[string]pokemons.Pokemon, len(trainer.Pokemons))
+	for pokemonId, pokemon := range trainer.Pokemons {
+		trainerCopy.Pokemons[pokemonId] = pokemon
+	}
+
+	return &trainerCopy, nil
+}
+
+func (f *fakeTrainers) verify(method, username string) (*bool, error) {
+	if err := f.faults.call(method); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	_, err := f.trainer(username)
+	f.lock.Unlock()
+
+	valid := err == nil
+	return &valid, nil
+}
+
+func (f *fakeTrainers) VerifyItems(username, _, _ string) (*bool, error) {
+	return f.verify("VerifyItems", username)
+}
+
+func (f *fakeTrainers) VerifyPokemons(username string, _ map[string]string, _ string) (*bool, error) {
+	return f.verify("VerifyPokemons", username)
+}
+
+func (f *fakeTrainers) VerifyTrainerStats(username, _, _ string) (*bool, error) {
+	return f.verify("VerifyTrainerStats", username)
+}
+
+func (f *fakeTrainers) RemoveItems(username string, itemIds []string, _ string) (map[string]items.Item, error) {
+	if err := f.faults.call("RemoveItems"); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, itemId := range itemIds {
+		if _, ok := trainer.Items[itemId]; !ok {
+			return nil, newItemNotOwnedError(itemId)
+		}
+	}
+
+	removed := make(map[string]items.Item, len(itemIds))
+	for _, itemId := range itemIds {
+		removed[itemId] = trainer.Items[itemId]
+		delete(trainer.Items, itemId)
+	}
+
+	return removed, nil
+}
+
+func (f *fakeTrainers) AddItems(username string, toAdd []items.Item, _ string) (map[string]items.Item, error) {
+	if err := f.faults.call("AddItems"); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make(map[string]items.Item, len(toAdd))
+	for _, item := range toAdd {
+		trainer.Items[item.Id] = item
+		added[item.Id] = item
+	}
+
+	return added, nil
+}
+
+func (f *fakeTrainers) AddPokemonToTrainer(username string, pokemon pokemons.Pokemon) (*pokemons.Pokemon, error) {
+	if err := f.faults.call("AddPokemonToTrainer"); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	trainer.Pokemons[pokemon.Id] = pokemon
+	return &pokemon, nil
+}
+
+func (f *fakeTrainers) RemovePokemonFromTrainer(username, pokemonId string) error {
+	if err := f.faults.call("RemovePokemonFromTrainer"); err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := trainer.Pokemons[pokemonId]; !ok {
+		return newPokemonNotOwnedError(pokemonId)
+	}
+
+	delete(trainer.Pokemons, pokemonId)
+	return nil
+}
+
+func (f *fakeTrainers) UpdateTrainerStats(username string, stats utils.TrainerStats,
+	_ string) (*utils.TrainerStats, error) {
+	if err := f.faults.call("UpdateTrainerStats"); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	trainer.Stats = stats
+	return &stats, nil
+}
+
+func (f *fakeTrainers) ItemsTokenFor(username, _ string) (string, error) {
+	if err := f.faults.call("ItemsTokenFor"); err != nil {
+		return "", err
+	}
+
+	return fakeItemsTokenPrefix + username, nil
+}
+
+func (f *fakeTrainers) PokemonTokensFor(username, _ string) ([]string, error) {
+	if err := f.faults.call("PokemonTokensFor"); err != nil {
+		return nil, err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	trainer, err := f.trainer(username)
+	if err != nil {
+		return nil, err
+	}
+
+	pokemonTokens := make([]string, 0, len(trainer.Pokemons))
+	for pokemonId := range trainer.Pokemons {
+		pokemonTokens = append(pokemonTokens, fakePokemonTokenPrefix+pokemonId)
+	}
+
+	return pokemonTokens, nil
+}
+
+func (f *fakeTrainers) StatsTokenFor(username, _ string) (string, error) {
+	if err := f.faults.call("StatsTokenFor"); err != nil {
+		return "", err
+	}
+
+	return fakeStatsTokenPrefix + username, nil
+}
+
+// fakeNotifications only logs what would have been sent
+type fakeNotifications struct {
+	faults fakeFaults
+}
+
+func (f *fakeNotifications) AddNotification(notification *notificationMessages.NotificationMessage,
+	_ string) error {
+	if err := f.faults.call("AddNotification"); err != nil {
+		return err
+	}
+
+	log.Infof("fake notification for %s: %s %s", notification.Notification.Username,
+		notification.Notification.Type, notification.Notification.Content)
+	return nil
+}
+
+// fakeTokens verifies the tokens given out by the fake trainers, which hold what the trainer owns
+// when the token is read instead of when it was given out
+type fakeTokens struct {
+	fakes *fakeTrainers
+}
+
+// fakeTrainer reads the trainer named by a fake token, failing with invalid when it is not one
+func (f fakeTokens) fakeTrainer(token, prefix string, invalid error) (*utils.Trainer, error) {
+	if !strings.HasPrefix(token, prefix) {
+		return nil, invalid
+	}
+
+	trainer, err := f.fakes.GetTrainerByUsername(strings.TrimPrefix(token, prefix))
+	if err != nil {
+		return nil, invalid
+	}
+
+	return trainer, nil
+}
+
+func (f fakeTokens) AuthToken(header http.Header) (*tokens.AuthToken, error) {
+	trainer, err := f.fakeTrainer(header.Get(tokens.AuthTokenHeaderName), fakeAuthTokenPrefix,
+		tokens.ErrorInvalidAuthToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokens.AuthToken{Username: trainer.Username}, nil
+}
+
+func (f fakeTokens) ItemsToken(header http.Header) (*tokens.ItemsToken, error) {
+	trainer, err := f.fakeTrainer(header.Get(tokens.ItemsTokenHeaderName), fakeItemsTokenPrefix,
+		tokens.ErrorInvalidItemsToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokens.ItemsToken{
+		Username:  trainer.Username,
+		Items:     trainer.Items,
+		ItemsHash: fakeItemsTokenPrefix + trainer.Username,
+	}, nil
+}
+
+// PokemonTokens looks for each pokemon among every fake trainer, as pokemon tokens do not name
+// their owner
+func (f fakeTokens) PokemonTokens(header http.Header) ([]*tokens.PokemonToken, error) {
+	f.fakes.lock.Lock()
+	defer f.fakes.lock.Unlock()
+
+	pokemonTkns := header[http.CanonicalHeaderKey(tokens.PokemonsTokenHeaderName)]
+	verified := make([]*tokens.PokemonToken, 0, len(pokemonTkns))
+	for _, pokemonTkn := range pokemonTkns {
+		if !strings.HasPrefix(pokemonTkn, fakePokemonTokenPrefix) {
+			return nil, tokens.ErrorInvalidPokemonTokens
+		}
+
+		pokemonId := strings.TrimPrefix(pokemonTkn, fakePokemonTokenPrefix)
+		pokemon, ok := f.fakes.pokemon(pokemonId)
+		if !ok {
+			return nil, tokens.ErrorInvalidPokemonTokens
+		}
+
+		verified = append(verified, &tokens.PokemonToken{Pokemon: pokemon, PokemonHash: pokemonTkn})
+	}
+
+	return verified, nil
+}
+
+func (f fakeTokens) StatsToken(header http.Header) (*tokens.TrainerStatsToken, error) {
+	trainer, err := f.fakeTrainer(header.Get(tokens.StatsTokenHeaderName), fakeStatsTokenPrefix,
+		tokens.ErrorInvalidStatsToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokens.TrainerStatsToken{
+		TrainerStats: trainer.Stats,
+		TrainerHash:  fakeStatsTokenPrefix + trainer.Username,
+	}, nil
+}
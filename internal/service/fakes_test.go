@@ -0,0 +1,60 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/NOVAPokemon/utils/items"
+)
+
+func TestFakeFaults(t *testing.T) {
+	faults := fakeFaults{latency: 20 * time.Millisecond, failures: []string{"AddItems"}}
+	fakes := newFakeTrainers(nil, faults)
+
+	start := time.Now()
+	if _, err := fakes.AddItems("ash", nil, ""); err == nil {
+		t.Error("AddItems did not fail")
+	}
+	if took := time.Since(start); took < faults.latency {
+		t.Errorf("AddItems took %s, expected at least %s", took, faults.latency)
+	}
+
+	if _, err := fakes.ItemsTokenFor("ash", ""); err != nil {
+		t.Errorf("ItemsTokenFor failed without being asked to: %s", err)
+	}
+}
+
+func TestFakeCensus(t *testing.T) {
+	fakes, cleanup := setupCommitTest(t)
+	defer cleanup()
+
+	if _, taken := fakes.census(func() bool { return true }); taken {
+		t.Error("census was taken while busy")
+	}
+
+	census, taken := fakes.census(func() bool { return false })
+	if !taken {
+		t.Fatal("census was not taken")
+	}
+
+	if !reflect.DeepEqual(census, fakes.initial) {
+		t.Errorf("census %+v differs from the initial %+v with nothing traded", census, fakes.initial)
+	}
+
+	// misty gets a copy of the potion and ash loses pikachu
+	if _, err := fakes.AddItems("misty", []items.Item{{Id: "ash-potion", Name: "potion"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := fakes.RemovePokemonFromTrainer("ash", "ash-pikachu"); err != nil {
+		t.Fatal(err)
+	}
+
+	duplicated, lost := fakes.count().compare(fakes.initial)
+	if !reflect.DeepEqual(duplicated, []string{"ash-potion"}) {
+		t.Errorf("found %q duplicated, expected only ash-potion", duplicated)
+	}
+	if !reflect.DeepEqual(lost, []string{"ash-pikachu"}) {
+		t.Errorf("found %q lost, expected only ash-pikachu", lost)
+	}
+}
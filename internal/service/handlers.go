@@ -0,0 +1,1219 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/api"
+	"github.com/NOVAPokemon/utils/clients"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/notifications"
+	"github.com/NOVAPokemon/utils/pokemons"
+	"github.com/NOVAPokemon/utils/tokens"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	notificationMessages "github.com/NOVAPokemon/utils/websockets/notifications"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	httpClient = &http.Client{
+		Timeout:   ws.Timeout,
+		Transport: clients.NewTransport(),
+	}
+	basicClient = clients.NewBasicClient(false, "")
+
+	serverName          string
+	serviceNameHeadless string
+	commsManager        ws.CommunicationManager
+
+	// errors ending a trade that trainers are told about
+	abortReasons = map[error]errorCode{
+		errorTradeInactive:       codeTradeInactive,
+		errorTradeExpired:        codeTradeExpired,
+		errorTooManyViolations:   codeProtocolViolations,
+		errorTrainerDisconnected: codeTrainerDisconnected,
+	}
+
+	notificationsClient notificationsService
+	journal             tradeJournal
+	lobbies             lobbyStore
+	history             tradeHistory
+	accounts            accountRegistry
+	offers              offerStore
+	audit               auditLog
+)
+
+// loadServerNames reads the names this replica and its headless service are reached by
+func loadServerNames() {
+	if aux, exists := os.LookupEnv(utils.HostnameEnvVar); exists {
+		serverName = aux
+	} else {
+		log.Fatal("Could not load server name")
+	}
+
+	if aux, exists := os.LookupEnv(utils.HeadlessServiceNameEnvVar); exists {
+		serviceNameHeadless = aux
+	} else {
+		log.Fatal("Could not load headless service name")
+	}
+}
+
+func handleGetLobbies(w http.ResponseWriter, r *http.Request) {
+	_, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetLobbiesError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var availableLobbies []utils.Lobby
+	for _, lobby := range lobbies.List(lobbyWaiting) {
+		wsLobby := lobby.wsLobby
+		select {
+		case <-wsLobby.Started:
+		default:
+			availableLobbies = append(availableLobbies, utils.Lobby{
+				Id:       wsLobby.Id,
+				Username: wsLobby.TrainerUsernames[0],
+			})
+		}
+	}
+
+	log.Infof("Request for trade lobbies, response %+v", availableLobbies)
+	js, err := json.Marshal(availableLobbies)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetLobbiesError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetLobbiesError(err), codeInternalError, http.StatusInternalServerError)
+	}
+}
+
+// createLobbyRequest extends api.CreateLobbyRequest with the trainers invited to trades with
+// more than two trainers. Usernames takes the place of Username when set.
+type createLobbyRequest struct {
+	api.CreateLobbyRequest
+	Usernames []string
+}
+
+func (request *createLobbyRequest) participants(creator string) ([]string, error) {
+	invited := request.Usernames
+	if len(invited) == 0 {
+		invited = []string{request.Username}
+	}
+
+	participants := append([]string{creator}, invited...)
+	if len(participants) > config.MaxTradeParticipants {
+		return nil, newInvalidParticipantsError(fmt.Sprintf("at most %d trainers can trade together",
+			config.MaxTradeParticipants))
+	}
+
+	seen := make(map[string]bool, len(participants))
+	for _, username := range participants {
+		if username == "" {
+			return nil, newInvalidParticipantsError("empty username")
+		}
+
+		if seen[username] {
+			return nil, newInvalidParticipantsError(fmt.Sprintf("%s invited more than once", username))
+		}
+		seen[username] = true
+	}
+
+	return participants, nil
+}
+
+func handleCreateTradeLobby(w http.ResponseWriter, r *http.Request) {
+	var request createLobbyRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateTradeError(err), codeBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateTradeError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	participants, err := request.participants(authClaims.Username)
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapCreateTradeError(err), codeBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	trackedInfo := ws.GetTrackInfoFromHeader(&r.Header)
+
+	lobbyId := primitive.NewObjectID()
+
+	lobby := newTradeLobby(lobbyId.Hex(), participants, &trackedInfo)
+
+	lobbyLimitLock.Lock()
+	if countTrainerLobbies(authClaims.Username, nil) >= config.MaxLobbiesPerTrainer {
+		lobbyLimitLock.Unlock()
+		err = newTooManyLobbiesError(authClaims.Username)
+		logWarnAndSendHTTPError(w, wrapCreateTradeError(err), codeTooManyLobbies, http.StatusTooManyRequests)
+		return
+	}
+	err = lobbies.Create(lobby)
+	lobbyLimitLock.Unlock()
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateTradeError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	recordAuditEvent(lobbyId.Hex(), auditLobbyCreated, authClaims.Username,
+		map[string]interface{}{"trainers": participants}, &trackedInfo)
+
+	resp := api.CreateLobbyResponse{
+		LobbyId:    lobbyId.Hex(),
+		ServerName: serverName,
+	}
+	respBytes, err := json.Marshal(resp)
+	if err != nil {
+		_ = lobbies.Delete(lobbyId.Hex())
+		logAndSendHTTPError(w, wrapCreateTradeError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(respBytes)
+	if err != nil {
+		log.Error(wrapCreateTradeError(err))
+	}
+
+	log.Info("created lobby ", lobbyId)
+
+	go cleanLobby(trackedInfo, lobby, time.Duration(config.InviteTimeout))
+}
+
+func handleStatus(w http.ResponseWriter, _ *http.Request) {
+	js, err := json.Marshal(config)
+	if err != nil {
+		logAndSendHTTPError(w, wrapStatusError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		logAndSendHTTPError(w, wrapStatusError(err), codeInternalError, http.StatusInternalServerError)
+	}
+}
+
+func handleJoinTradeLobby(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		err = ws.WrapUpgradeConnectionError(err)
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	claims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		err = ws.WrapUpgradeConnectionError(err)
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	vars := mux.Vars(r)
+	lobbyIdHex, ok := vars[api.TradeIdVar]
+	if !ok {
+		handleJoinConnError(errorNoTradeId, conn)
+		return
+	}
+
+	lobbyId, err := primitive.ObjectIDFromHex(lobbyIdHex)
+	if err != nil {
+		handleJoinConnError(errorInvalidId, conn)
+		return
+	}
+
+	lobby, state, ok := lobbies.Get(lobbyIdHex)
+	if !ok {
+		if owner, proxy := shouldProxyJoin(r, lobbyIdHex); proxy {
+			if err = proxyJoinToOwner(conn, r, owner); err != nil {
+				handleJoinConnError(err, conn)
+			}
+			return
+		}
+	}
+
+	if !ok {
+		err = newTradeLobbyNotFoundError(lobbyIdHex)
+		handleJoinWarning(err, conn)
+		return
+	}
+
+	username := claims.Username
+	if !lobby.isExpected(username) {
+		err = newPlayerNotExpectedError(username)
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	if state == lobbyOngoing {
+		resumeTrade(lobby, username, r.Header.Get(tokens.AuthTokenHeaderName), conn)
+		return
+	}
+
+	authToken := r.Header.Get(tokens.AuthTokenHeaderName)
+
+	trainersClient := newTrainersClient()
+	inventory, err := extractAndVerifyInventory(trainersClient, username, authToken, r.Header)
+	if err != nil {
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	inventory.stats, inventory.statsHash, err = extractAndVerifyStats(trainersClient, username, authToken,
+		r.Header)
+	if err != nil {
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	// without a stats token, the level the rules need is asked to the trainers service
+	if inventory.statsHash == "" && config.Rules.MinTrainerLevel > 0 {
+		trainer, err := trainersClient.GetTrainerByUsername(username)
+		if err != nil {
+			handleJoinConnError(err, conn)
+			return
+		}
+		inventory.stats.Level = trainer.Stats.Level
+	}
+
+	now := time.Now()
+	inventory.record, err = config.Rules.loadTraderRecord(username, inventory.stats, now)
+	if err != nil {
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	if err = config.Rules.checkTrader(inventory.record, now); err != nil {
+		rejectJoin(err, codeTradeRuleViolated, conn)
+		return
+	}
+
+	lobbyLimitLock.Lock()
+	if countTrainerLobbies(username, lobby) >= config.MaxLobbiesPerTrainer {
+		lobbyLimitLock.Unlock()
+		rejectJoin(newTooManyLobbiesError(username), codeTooManyLobbies, conn)
+		return
+	}
+	trainerNr, err := lobby.addTrainer(claims.Username, inventory, r.Header.Get(tokens.AuthTokenHeaderName),
+		conn, commsManager)
+	lobbyLimitLock.Unlock()
+	if err != nil {
+		handleJoinConnError(err, conn)
+		return
+	}
+
+	trackedInfo := ws.GetTrackInfoFromHeader(&r.Header)
+	recordAuditEvent(lobbyIdHex, auditTrainerJoined, username, nil, &trackedInfo)
+
+	if trainerNr == len(lobby.expected) {
+		if !atomic.CompareAndSwapInt32(&lobby.initialized, 0, 1) {
+			return
+		}
+
+		// whatever happens to the trade, the offers it held are free again
+		defer escrow.ReleaseLobby(lobbyIdHex)
+
+		if err = lobbies.Start(lobbyId.Hex()); err != nil {
+			log.Error(wrapJoinTradeError(err))
+		}
+
+		outcome := tradeFailed
+		err = lobby.startTrade()
+		if code, aborted := abortReasons[err]; aborted {
+			log.Warnf("closing lobby %s: %s", lobbyIdHex, err)
+			if err != errorTooManyViolations {
+				outcome = tradeTimedOut
+			}
+			lobby.finishWithError(code, err.Error()) // tell trainers why the trade was aborted
+		} else if err != nil {
+			ws.FinishLobby(lobby.wsLobby) // abort lobby on error
+			lobby.closeConns()
+		} else { // lobby finished properly
+			err = commitChanges(trainersClient, lobby)
+			if err != nil {
+				log.Error(err)
+				lobby.finishWithError(commitFailure(err)) // report failed commit to every trainer
+			} else {
+				outcome = tradeCompleted
+				lobby.finish() // finish gracefully
+				log.Infof("closing lobby %s as expected", lobbyIdHex)
+			}
+		}
+		recordTradeOutcome(lobby, outcome)
+		emitTradeFinish()
+		if err = lobbies.Delete(lobby.wsLobby.Id); err != nil {
+			log.Error(wrapJoinTradeError(err))
+		}
+	} else if trainerNr == 1 {
+		lobby.wsLobby.StartTrackInfo = &trackedInfo
+		for _, invited := range lobby.expected {
+			if invited == username {
+				continue
+			}
+
+			err = postNotification(username, invited, lobbyId.Hex(), authToken, trackedInfo)
+			if err != nil {
+				log.Error(wrapCreateTradeError(err))
+			}
+		}
+	}
+}
+
+// extractAndVerifyInventory reads the items and pokemons tokens of a request and checks with the
+// trainers service that they are still current
+func extractAndVerifyInventory(trainersClient trainersService, username, authToken string,
+	header http.Header) (trainerInventory, error) {
+	itemsClaims, err := verifier.ItemsToken(header)
+	if err != nil {
+		return trainerInventory{}, err
+	}
+
+	valid, err := trainersClient.VerifyItems(username, itemsClaims.ItemsHash, authToken)
+	if err != nil {
+		return trainerInventory{}, err
+	}
+
+	if !*valid {
+		return trainerInventory{}, tokens.ErrorInvalidItemsToken
+	}
+
+	pokemonTkns, err := verifier.PokemonTokens(header)
+	if err != nil {
+		return trainerInventory{}, err
+	}
+
+	inventory := trainerInventory{
+		items:         itemsClaims.Items,
+		itemsHash:     itemsClaims.ItemsHash,
+		pokemons:      make(pokemonsMap, len(pokemonTkns)),
+		pokemonHashes: make(map[string]string, len(pokemonTkns)),
+	}
+	for _, pokemonTkn := range pokemonTkns {
+		inventory.pokemons[pokemonTkn.Pokemon.Id] = pokemonTkn.Pokemon
+		inventory.pokemonHashes[pokemonTkn.Pokemon.Id] = pokemonTkn.PokemonHash
+	}
+
+	valid, err = trainersClient.VerifyPokemons(username, inventory.pokemonHashes, authToken)
+	if err != nil {
+		return trainerInventory{}, err
+	}
+
+	if !*valid {
+		return trainerInventory{}, errorInvalidPokemonTokens
+	}
+
+	return inventory, nil
+}
+
+// resumeTrade lets a trainer that lost its connection continue an ongoing trade, as long as it
+// presents the auth token it joined with
+func resumeTrade(lobby *tradeLobby, username, authToken string, conn *websocket.Conn) {
+	trainerNum, joined := lobby.trainerNum(username)
+
+	lobby.tokensLock.Lock()
+	sameToken := joined && authToken != "" && lobby.authTokens[trainerNum] == authToken
+	lobby.tokensLock.Unlock()
+
+	if !sameToken {
+		handleJoinWarning(newCannotResumeError(username, lobby.wsLobby.Id), conn)
+		return
+	}
+
+	resumedConn := newResumedConn(conn, commsManager)
+	if !lobby.resume(trainerNum, resumedConn) {
+		resumedConn.close()
+		log.Warn(wrapJoinTradeError(newCannotResumeError(username, lobby.wsLobby.Id)))
+	}
+}
+
+func handleRejectTradeLobby(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapRejectTradeError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	lobbyIdHex, ok := vars[api.TradeIdVar]
+	if !ok {
+		logAndSendHTTPError(w, wrapRejectTradeError(errorInvalidId), codeInvalidLobbyId, http.StatusBadRequest)
+		return
+	}
+
+	lobby, _, ok := lobbies.Get(lobbyIdHex)
+	if !ok {
+		err = newTradeLobbyNotFoundError(lobbyIdHex)
+		logWarnAndSendHTTPError(w, wrapRejectTradeError(err), codeLobbyNotFound, http.StatusNotFound)
+		return
+	}
+
+	for _, trainer := range lobby.expected {
+		if trainer == authClaims.Username {
+			log.Infof("%s rejected invite for lobby %s", trainer, lobbyIdHex)
+			trackedInfo := ws.GetTrackInfoFromHeader(&r.Header)
+			recordAuditEvent(lobbyIdHex, auditInviteRejected, trainer, nil, &trackedInfo)
+			lobby.reject.Do(func() {
+				close(lobby.rejected)
+			})
+			return
+		}
+	}
+
+	err = newPlayerNotExpectedError(authClaims.Username)
+	logAndSendHTTPError(w, wrapRejectTradeError(err), codePlayerNotExpected, http.StatusUnauthorized)
+}
+
+func handleGetTradeHistory(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeHistoryError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	username := mux.Vars(r)[usernameVar]
+	if username != authClaims.Username && !hasSupportToken(r) {
+		err = newHistoryForbiddenError(authClaims.Username, username)
+		logAndSendHTTPError(w, wrapGetTradeHistoryError(err), codeForbidden, http.StatusForbidden)
+		return
+	}
+
+	outcome := tradeOutcome(r.URL.Query().Get(outcomeQueryParam))
+	if outcome != "" && !validOutcomes[outcome] {
+		err = newInvalidOutcomeError(string(outcome))
+		logAndSendHTTPError(w, wrapGetTradeHistoryError(err), codeBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	records, err := history.ListByTrainer(username, outcome)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeHistoryError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]tradeHistoryEntry, len(records))
+	for i, record := range records {
+		entries[i] = record.toHistoryEntry(username)
+	}
+
+	js, err := json.Marshal(entries)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeHistoryError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeHistoryError(err), codeInternalError, http.StatusInternalServerError)
+	}
+}
+
+// handleGetTradeAudit exports every event recorded for a lobby, in order, to support
+func handleGetTradeAudit(w http.ResponseWriter, r *http.Request) {
+	if !hasSupportToken(r) {
+		logAndSendHTTPError(w, wrapGetTradeAuditError(errorAuditForbidden), codeForbidden, http.StatusForbidden)
+		return
+	}
+
+	lobbyId := mux.Vars(r)[lobbyIdVar]
+	events, err := audit.ListByLobby(lobbyId)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeAuditError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	if len(events) == 0 {
+		err = newTradeLobbyNotFoundError(lobbyId)
+		logWarnAndSendHTTPError(w, wrapGetTradeAuditError(err), codeLobbyNotFound, http.StatusNotFound)
+		return
+	}
+
+	js, err := json.Marshal(events)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeAuditError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetTradeAuditError(err), codeInternalError, http.StatusInternalServerError)
+	}
+}
+
+func handleCreateTradeOffer(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateOfferError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var request tradeOfferRequest
+	if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logAndSendHTTPError(w, wrapCreateOfferError(err), codeBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	offer, ok := createTradeOffer(w, r, authClaims.Username, &request, "")
+	if !ok {
+		return
+	}
+
+	writeOfferResponse(w, &tradeOfferResponse{Offer: offer})
+}
+
+func handleGetTradeOffers(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetOffersError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	trainerOffers, err := offers.ListByTrainer(authClaims.Username)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetOffersError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	for _, offer := range trainerOffers {
+		if err = offer.expire(); err != nil {
+			log.Error(wrapGetOffersError(err))
+		}
+	}
+
+	if trainerOffers == nil {
+		trainerOffers = []*tradeOffer{}
+	}
+
+	js, err := json.Marshal(trainerOffers)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetOffersError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		logAndSendHTTPError(w, wrapGetOffersError(err), codeInternalError, http.StatusInternalServerError)
+	}
+}
+
+// handleAcceptTradeOffer verifies that both trainers still own what the offer exchanges and
+// commits it the same way a finished trade lobby is committed
+func handleAcceptTradeOffer(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	offer, ok := getPendingOffer(w, r, authClaims.Username)
+	if !ok {
+		return
+	}
+
+	authToken := r.Header.Get(tokens.AuthTokenHeaderName)
+	trackedInfo := ws.GetTrackInfoFromHeader(&r.Header)
+	senderToken, granted := grants.get(offer.Id)
+	if !granted {
+		if _, err = offers.Transition(offer.Id, offerPending, offerFailed); err != nil {
+			log.Error(wrapAnswerOfferError(err))
+		}
+		offer.State = offerFailed
+		notifyOffer(offer.Sender, offer.Recipient, offer, authToken, trackedInfo)
+
+		err = newOfferNotGrantedError(offer.Id)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeOfferNotGranted, http.StatusConflict)
+		return
+	}
+
+	trainersClient := newTrainersClient()
+	inventory, err := extractAndVerifyInventory(trainersClient, offer.Recipient, authToken, r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	requestedItems, err := offeredItems(inventory, offer.RequestedItems)
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeItemNotOwned, http.StatusConflict)
+		return
+	}
+
+	requestedPokemons, err := offeredPokemons(inventory, offer.RequestedPokemons)
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codePokemonNotOwned, http.StatusConflict)
+		return
+	}
+
+	// the sender was checked when making the offer, but what both give is checked again
+	recipientRecord, err := loadOfferTrader(trainersClient, offer.Recipient)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	senderRecord, err := loadOfferTrader(trainersClient, offer.Sender)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	err = config.Rules.checkTrader(recipientRecord, now)
+	if err == nil {
+		err = checkOffered(recipientRecord, requestedItems, requestedPokemons, now)
+	}
+	if err == nil {
+		err = checkOffered(senderRecord, offer.Items, offer.Pokemons, now)
+	}
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeTradeRuleViolated, http.StatusForbidden)
+		return
+	}
+
+	owns, err := ownsOffered(trainersClient, offer.Sender, offer.Items, offer.Pokemons)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	if !owns {
+		if _, err = offers.Transition(offer.Id, offerPending, offerFailed); err != nil {
+			log.Error(wrapAnswerOfferError(err))
+		}
+		grants.revoke(offer.Id)
+		err = newItemsChangedError(offer.Sender)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeItemNotOwned, http.StatusConflict)
+		return
+	}
+
+	defer escrow.ReleaseLobby(offer.Id)
+	if !lockOffer(offer, requestedItems, requestedPokemons) {
+		err = newOfferInEscrowError(offer.Id)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeItemInEscrow, http.StatusConflict)
+		return
+	}
+
+	if !transitionOffer(w, offer, offerPending, offerAccepted) {
+		return
+	}
+	grants.revoke(offer.Id)
+
+	entry := offer.journalEntry(requestedItems, requestedPokemons, senderToken, authToken)
+	err = journal.Record(entry)
+	if err == nil {
+		err = applyCommit(trainersClient, entry, entry.AuthTokens)
+	}
+
+	if err != nil {
+		if _, transitionErr := offers.Transition(offer.Id, offerAccepted, offerFailed); transitionErr != nil {
+			log.Error(wrapAnswerOfferError(transitionErr))
+		}
+		offer.State = offerFailed
+		recordOfferOutcome(offer, tradeFailed, requestedItems, requestedPokemons)
+		notifyOffer(offer.Sender, offer.Recipient, offer, authToken, trackedInfo)
+
+		code, _ := commitFailure(err)
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), code, http.StatusInternalServerError)
+		return
+	}
+
+	recordOfferOutcome(offer, tradeCompleted, requestedItems, requestedPokemons)
+	notifyOffer(offer.Sender, offer.Recipient, offer, authToken, trackedInfo)
+
+	response := &tradeOfferResponse{Offer: offer}
+	if itemsToken, err := trainersClient.ItemsTokenFor(offer.Recipient, authToken); err != nil {
+		log.Error(wrapAnswerOfferError(err))
+	} else {
+		response.Tokens = append(response.Tokens, itemsToken)
+	}
+
+	if len(offer.Pokemons) > 0 || len(requestedPokemons) > 0 {
+		if pokemonTokens, err := trainersClient.PokemonTokensFor(offer.Recipient, authToken); err != nil {
+			log.Error(wrapAnswerOfferError(err))
+		} else {
+			response.Tokens = append(response.Tokens, pokemonTokens...)
+		}
+	}
+
+	writeOfferResponse(w, response)
+}
+
+func handleDeclineTradeOffer(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	offer, ok := getPendingOffer(w, r, authClaims.Username)
+	if !ok {
+		return
+	}
+
+	if !transitionOffer(w, offer, offerPending, offerDeclined) {
+		return
+	}
+	grants.revoke(offer.Id)
+
+	recordOfferOutcome(offer, tradeRejected, []items.Item{}, []pokemons.Pokemon{})
+	notifyOffer(offer.Sender, offer.Recipient, offer, r.Header.Get(tokens.AuthTokenHeaderName),
+		ws.GetTrackInfoFromHeader(&r.Header))
+
+	writeOfferResponse(w, &tradeOfferResponse{Offer: offer})
+}
+
+// handleCounterTradeOffer answers an offer with a new one from its recipient to its sender
+func handleCounterTradeOffer(w http.ResponseWriter, r *http.Request) {
+	authClaims, err := verifier.AuthToken(r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var request tradeOfferRequest
+	if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeBadRequest, http.StatusBadRequest)
+		return
+	}
+
+	offer, ok := getPendingOffer(w, r, authClaims.Username)
+	if !ok {
+		return
+	}
+
+	if !transitionOffer(w, offer, offerPending, offerCountered) {
+		return
+	}
+
+	request.Recipient = offer.Sender
+	counterOffer, ok := createTradeOffer(w, r, authClaims.Username, &request, offer.Id)
+	if !ok {
+		// the original offer can still be answered if the counter offer was not made
+		if _, err = offers.Transition(offer.Id, offerCountered, offerPending); err != nil {
+			log.Error(wrapAnswerOfferError(err))
+		}
+		return
+	}
+
+	grants.revoke(offer.Id)
+	recordOfferOutcome(offer, tradeRejected, []items.Item{}, []pokemons.Pokemon{})
+	writeOfferResponse(w, &tradeOfferResponse{Offer: counterOffer})
+}
+
+// createTradeOffer validates and stores an offer from sender, notifying its recipient. Errors are
+// sent back to the client, in which case ok is false.
+func createTradeOffer(w http.ResponseWriter, r *http.Request, sender string, request *tradeOfferRequest,
+	counterOf string) (*tradeOffer, bool) {
+	if err := request.validate(sender); err != nil {
+		logWarnAndSendHTTPError(w, wrapCreateOfferError(err), codeBadRequest, http.StatusBadRequest)
+		return nil, false
+	}
+
+	authToken := r.Header.Get(tokens.AuthTokenHeaderName)
+	trainersClient := newTrainersClient()
+	inventory, err := extractAndVerifyInventory(trainersClient, sender, authToken, r.Header)
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateOfferError(err), codeUnauthorized, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	offerItems, err := offeredItems(inventory, request.Items)
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapCreateOfferError(err), codeItemNotOwned, http.StatusBadRequest)
+		return nil, false
+	}
+
+	offerPokemons, err := offeredPokemons(inventory, request.Pokemons)
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapCreateOfferError(err), codePokemonNotOwned, http.StatusBadRequest)
+		return nil, false
+	}
+
+	record, err := loadOfferTrader(trainersClient, sender)
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	recipientRecord, requestedItems, requestedPokemons, err := loadRequested(trainersClient, request.Recipient,
+		request.RequestedItems, request.RequestedPokemons)
+	if err != nil {
+		logAndSendHTTPError(w, wrapCreateOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	now := time.Now()
+	err = config.Rules.checkTrader(record, now)
+	if err == nil {
+		err = checkOffered(record, offerItems, offerPokemons, now)
+	}
+	if err == nil {
+		err = checkOffered(recipientRecord, requestedItems, requestedPokemons, now)
+	}
+	if err != nil {
+		logWarnAndSendHTTPError(w, wrapCreateOfferError(err), codeTradeRuleViolated, http.StatusForbidden)
+		return nil, false
+	}
+
+	offer := &tradeOffer{
+		Id:                primitive.NewObjectID().Hex(),
+		Sender:            sender,
+		Recipient:         request.Recipient,
+		Items:             offerItems,
+		Pokemons:          offerPokemons,
+		RequestedItems:    request.RequestedItems,
+		RequestedPokemons: request.RequestedPokemons,
+		State:             offerPending,
+		CounterOf:         counterOf,
+		CreatedAt:         now,
+		ExpiresAt:         now.Add(time.Duration(config.OfferTimeout)),
+	}
+
+	grants.grant(offer.Id, authToken)
+	if err = offers.Create(offer); err != nil {
+		grants.revoke(offer.Id)
+		logAndSendHTTPError(w, wrapCreateOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	log.Infof("%s offered trade %s to %s", sender, offer.Id, offer.Recipient)
+	notifyOffer(offer.Recipient, sender, offer, authToken, ws.GetTrackInfoFromHeader(&r.Header))
+	return offer, true
+}
+
+// getPendingOffer loads the offer in the request for its recipient to answer. Errors are sent
+// back to the client, in which case ok is false.
+func getPendingOffer(w http.ResponseWriter, r *http.Request, username string) (*tradeOffer, bool) {
+	offerId := mux.Vars(r)[offerIdVar]
+	offer, ok, err := offers.Get(offerId)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if !ok {
+		err = newOfferNotFoundError(offerId)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeOfferNotFound, http.StatusNotFound)
+		return nil, false
+	}
+
+	if offer.Recipient != username {
+		err = newOfferForbiddenError(username, offerId)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeForbidden, http.StatusForbidden)
+		return nil, false
+	}
+
+	if err = offer.expire(); err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if offer.State == offerExpired {
+		err = newOfferNotPendingError(offerId, offer.State)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeOfferExpired, http.StatusGone)
+		return nil, false
+	}
+
+	if offer.State != offerPending {
+		err = newOfferNotPendingError(offerId, offer.State)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeOfferNotPending, http.StatusConflict)
+		return nil, false
+	}
+
+	return offer, true
+}
+
+// transitionOffer changes the state of the offer unless someone else answered it first. Errors
+// are sent back to the client, in which case it returns false.
+func transitionOffer(w http.ResponseWriter, offer *tradeOffer, from, to offerState) bool {
+	changed, err := offers.Transition(offer.Id, from, to)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return false
+	}
+
+	if !changed {
+		err = newOfferNotPendingError(offer.Id, from)
+		logWarnAndSendHTTPError(w, wrapAnswerOfferError(err), codeOfferNotPending, http.StatusConflict)
+		return false
+	}
+
+	offer.State = to
+	return true
+}
+
+// lockOffer holds everything the offer exchanges in escrow while it is committed, so none of it
+// is in a live trade at the same time
+func lockOffer(offer *tradeOffer, requestedItems []items.Item, requestedPokemons []pokemons.Pokemon) bool {
+	exchanged := []struct {
+		username string
+		items    []items.Item
+		pokemons []pokemons.Pokemon
+	}{
+		{offer.Sender, offer.Items, offer.Pokemons},
+		{offer.Recipient, requestedItems, requestedPokemons},
+	}
+
+	for _, side := range exchanged {
+		for _, item := range side.items {
+			if !escrow.Lock(offer.Id, side.username, escrowItem, item.Id) {
+				return false
+			}
+		}
+
+		for _, pokemon := range side.pokemons {
+			if !escrow.Lock(offer.Id, side.username, escrowPokemon, pokemon.Id) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func offeredItems(inventory trainerInventory, itemIds []string) ([]items.Item, error) {
+	offered := make([]items.Item, 0, len(itemIds))
+	for _, itemId := range itemIds {
+		item, ok := inventory.items[itemId]
+		if !ok {
+			return nil, newItemNotOwnedError(itemId)
+		}
+		offered = append(offered, item)
+	}
+
+	return offered, nil
+}
+
+func offeredPokemons(inventory trainerInventory, pokemonIds []string) ([]pokemons.Pokemon, error) {
+	offered := make([]pokemons.Pokemon, 0, len(pokemonIds))
+	for _, pokemonId := range pokemonIds {
+		pokemon, ok := inventory.pokemons[pokemonId]
+		if !ok {
+			return nil, newPokemonNotOwnedError(pokemonId)
+		}
+		offered = append(offered, pokemon)
+	}
+
+	return offered, nil
+}
+
+func writeOfferResponse(w http.ResponseWriter, response *tradeOfferResponse) {
+	js, err := json.Marshal(response)
+	if err != nil {
+		logAndSendHTTPError(w, wrapAnswerOfferError(err), codeInternalError, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(js)
+	if err != nil {
+		log.Error(wrapAnswerOfferError(err))
+	}
+}
+
+func hasSupportToken(r *http.Request) bool {
+	supportToken, exists := os.LookupEnv(supportTokenEnvVar)
+	return exists && supportToken != "" && r.Header.Get(supportTokenHeader) == supportToken
+}
+
+func handleJoinConnError(err error, conn *websocket.Conn) {
+	if errors.Cause(err) == ws.ErrorLobbyAlreadyFinished {
+		log.Warn(wrapJoinTradeError(err))
+	} else {
+		log.Error(wrapJoinTradeError(err))
+	}
+
+	if conn == nil {
+		return
+	}
+
+	err = conn.Close()
+	if err != nil {
+		log.Error(wrapJoinTradeError(err))
+	}
+}
+
+// rejectJoin tells the trainer why they can not join before closing the connection
+func rejectJoin(err error, code errorCode, conn *websocket.Conn) {
+	errorMsg := ErrorTradeMessage{
+		Code:  code,
+		Info:  err.Error(),
+		Fatal: true,
+	}.ConvertToWSMessage(ws.TrackedInfo{})
+	if writeErr := commsManager.WriteGenericMessageToConn(conn, errorMsg); writeErr != nil {
+		log.Warn(wrapJoinTradeError(writeErr))
+	}
+
+	handleJoinWarning(err, conn)
+}
+
+func handleJoinWarning(err error, conn *websocket.Conn) {
+	log.Warn(wrapJoinTradeError(err))
+
+	if conn == nil {
+		return
+	}
+
+	err = conn.Close()
+	if err != nil {
+		log.Error(wrapJoinTradeError(err))
+	}
+}
+
+// cleanLobby closes the lobby unless every trainer joined within the invite timeout, which is read
+// when the lobby is created
+func cleanLobby(createdTrackInfo ws.TrackedInfo, lobby *tradeLobby, inviteTimeout time.Duration) {
+	timer := time.NewTimer(inviteTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		if !atomic.CompareAndSwapInt32(&lobby.initialized, 0, 1) {
+			return
+		}
+
+		if ws.GetTrainersJoined(lobby.wsLobby) > 0 {
+			log.Warnf("closing lobby %s since time expired", lobby.wsLobby.Id)
+		}
+		for trainerNum := 0; trainerNum < ws.GetTrainersJoined(lobby.wsLobby); trainerNum++ {
+			updateClients(ErrorTradeMessage{
+				Code:  codeLobbyExpired,
+				Info:  errorLobbyExpired.Error(),
+				Fatal: true,
+			}.ConvertToWSMessage(createdTrackInfo), lobby.wsLobby.TrainerOutChannels[trainerNum])
+			select {
+			case lobby.wsLobby.TrainerOutChannels[trainerNum] <- ws.FinishMessage{Success: false}.ConvertToWSMessage():
+				select { // wait for proper finish of routine
+				case <-lobby.wsLobby.DoneListeningFromConn[trainerNum]:
+				case <-time.After(time.Duration(config.CleanupTimeout)):
+				}
+			}
+		}
+		ws.FinishLobby(lobby.wsLobby)
+		recordTradeOutcome(lobby, tradeTimedOut)
+		if err := lobbies.Delete(lobby.wsLobby.Id); err != nil {
+			log.Error(err)
+		}
+	case <-lobby.rejected:
+		for trainerNum := 0; trainerNum < ws.GetTrainersJoined(lobby.wsLobby); trainerNum++ {
+			select {
+			case <-lobby.wsLobby.DoneListeningFromConn[trainerNum]:
+			default:
+				select {
+				case lobby.wsLobby.TrainerOutChannels[trainerNum] <- trades.RejectTradeMessage{}.
+					ConvertToWSMessage(createdTrackInfo):
+					select { // wait for proper finish of routine
+					case <-lobby.wsLobby.DoneListeningFromConn[trainerNum]:
+					case <-time.After(time.Duration(config.CleanupTimeout)):
+					}
+				}
+			}
+		}
+		ws.FinishLobby(lobby.wsLobby)
+		recordTradeOutcome(lobby, tradeRejected)
+		if err := lobbies.Delete(lobby.wsLobby.Id); err != nil {
+			log.Error(err)
+		}
+	case <-lobby.wsLobby.Started:
+	}
+}
+
+// lobbyLimitLock is held while counting the lobbies of a trainer and creating or joining one, so
+// concurrent requests cannot go over the limit
+var lobbyLimitLock sync.Mutex
+
+// countTrainerLobbies counts the lobbies the trainer created or joined, other than except
+func countTrainerLobbies(username string, except *tradeLobby) int {
+	count := 0
+	for _, state := range []lobbyState{lobbyWaiting, lobbyOngoing} {
+		for _, lobby := range lobbies.List(state) {
+			if lobby != except && lobby.holds(username) {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+func postNotification(sender, receiver, lobbyId, authToken string, info ws.TrackedInfo) error {
+	toMarshal := notifications.WantsToTradeContent{
+		Username:       sender,
+		LobbyId:        lobbyId,
+		ServerHostname: serverName,
+	}
+
+	return sendNotification(receiver, notifications.WantsToTrade, toMarshal, authToken, info)
+}
+
+// notifyOffer tells a trainer about a trade offer sent by or answered by username
+func notifyOffer(receiver, username string, offer *tradeOffer, authToken string, info ws.TrackedInfo) {
+	toMarshal := tradeOfferNotificationContent{
+		OfferId:  offer.Id,
+		Username: username,
+		State:    offer.State,
+	}
+
+	if err := sendNotification(receiver, tradeOfferNotification, toMarshal, authToken, info); err != nil {
+		log.Error(wrapNotifyOfferError(err))
+	}
+}
+
+func sendNotification(receiver, notificationType string, content interface{}, authToken string,
+	info ws.TrackedInfo) error {
+	contentBytes, err := json.Marshal(content)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	notification := utils.Notification{
+		Id:       primitive.NewObjectID().Hex(),
+		Username: receiver,
+		Type:     notificationType,
+		Content:  string(contentBytes),
+	}
+
+	notificationMsg := notificationMessages.NotificationMessage{
+		Notification: notification,
+		Info:         info,
+	}
+
+	err = notificationsClient.AddNotification(&notificationMsg, authToken)
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NOVAPokemon/utils/api"
+	"github.com/NOVAPokemon/utils/tokens"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const tradeClientTimeout = time.Second
+
+// setupTradeServer serves the lobby handlers with the fake services of setupCommitTest, which
+// trainers reach with fake tokens. The returned function waits for every handler to return and
+// puts the services back.
+func setupTradeServer(t *testing.T) (*fakeTrainers, *httptest.Server, func()) {
+	t.Helper()
+
+	fakes, cleanupCommit := setupCommitTest(t)
+
+	previousTrainers, previousNotifications := newTrainersClient, notificationsClient
+	previousVerifier, previousManager := verifier, commsManager
+	useFakeServices(fakes)
+	commsManager = ws.JSONManager{}
+
+	// short timeouts so a trade left hanging by a failed test ends well within tradeClientTimeout
+	config = defaultConfig()
+	config.InviteTimeout = duration(500 * time.Millisecond)
+	config.InactivityTimeout = duration(500 * time.Millisecond)
+	config.TimeoutWarning = duration(100 * time.Millisecond)
+	config.ReconnectGrace = duration(50 * time.Millisecond)
+	config.FinishTimeout = duration(100 * time.Millisecond)
+	config.CleanupTimeout = duration(100 * time.Millisecond)
+
+	escrow = newTradeEscrow()
+	lobbies = newMemoryLobbyStore()
+	history = &memoryHistory{}
+	accounts = &memoryAccounts{firstSeen: map[string]time.Time{}}
+
+	offers = &memoryOffers{offers: map[string]*tradeOffer{}}
+	grants = &offerGrants{tokens: map[string]string{}}
+
+	router := mux.NewRouter()
+	for _, route := range routes {
+		if route.Pattern != "" {
+			router.HandleFunc(route.Pattern, route.HandlerFunc).Methods(route.Method)
+		}
+	}
+
+	// websocket connections are hijacked, so closing the server does not wait for their handlers
+	handlers := sync.WaitGroup{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		router.ServeHTTP(w, r)
+	}))
+
+	return fakes, server, func() {
+		server.Close()
+		handlers.Wait()
+		waitForLobbiesToClose(t)
+
+		newTrainersClient, notificationsClient = previousTrainers, previousNotifications
+		verifier, commsManager = previousVerifier, previousManager
+		cleanupCommit()
+	}
+}
+
+// waitForLobbiesToClose waits for the lobbies the test left behind to time out, as they are
+// only deleted once whatever runs them in the background is done with the services
+func waitForLobbiesToClose(t *testing.T) {
+	t.Helper()
+
+	deadline := time.Now().Add(tradeClientTimeout)
+	for len(lobbies.List(lobbyWaiting))+len(lobbies.List(lobbyOngoing)) > 0 {
+		if time.Now().After(deadline) {
+			t.Error("lobbies were left open after the test")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// postJSON posts body with the fake tokens of the trainer and decodes the answer into response,
+// returning the status
+func postJSON(t *testing.T, server *httptest.Server, path, username string, body,
+	response interface{}) int {
+	t.Helper()
+
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(post, server.URL+path, bytes.NewReader(bodyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = fakeTokensHeader(username)
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode
+}
+
+// fakeTokensHeader has the fake tokens of the trainer, with a pokemon token for each id given
+func fakeTokensHeader(username string, pokemonIds ...string) http.Header {
+	header := http.Header{}
+	header.Set(tokens.AuthTokenHeaderName, fakeAuthTokenPrefix+username)
+	header.Set(tokens.ItemsTokenHeaderName, fakeItemsTokenPrefix+username)
+	header.Set(tokens.StatsTokenHeaderName, fakeStatsTokenPrefix+username)
+	for _, pokemonId := range pokemonIds {
+		header.Add(tokens.PokemonsTokenHeaderName, fakePokemonTokenPrefix+pokemonId)
+	}
+
+	return header
+}
+
+func createTradeLobby(t *testing.T, server *httptest.Server, creator, invited string) string {
+	t.Helper()
+
+	var created api.CreateLobbyResponse
+	request := createLobbyRequest{CreateLobbyRequest: api.CreateLobbyRequest{Username: invited}}
+	if status := postJSON(t, server, api.StartTradePath, creator, request, &created); status != http.StatusOK {
+		t.Fatalf("creating a lobby answered %d", status)
+	}
+
+	return created.LobbyId
+}
+
+// tradeClient is a trainer in a trade lobby, talking to it over a websocket
+type tradeClient struct {
+	t        *testing.T
+	username string
+	conn     *websocket.Conn
+}
+
+func joinTradeLobby(t *testing.T, server *httptest.Server, lobbyId string, header http.Header) *tradeClient {
+	t.Helper()
+
+	joinPath := strings.Replace(api.JoinTradeRoute, "{"+api.TradeIdVar+"}", lobbyId, 1)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+joinPath, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	username := strings.TrimPrefix(header.Get(tokens.AuthTokenHeaderName), fakeAuthTokenPrefix)
+	return &tradeClient{t: t, username: username, conn: conn}
+}
+
+func (c *tradeClient) send(msgType string, data interface{}) {
+	c.t.Helper()
+
+	if err := c.conn.WriteJSON(ws.NewRequestMsg(msgType, data)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect skips messages until one of the type given arrives, failing on errors unless one is
+// expected
+func (c *tradeClient) expect(msgType string) map[string]interface{} {
+	c.t.Helper()
+
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(tradeClientTimeout)); err != nil {
+			c.t.Fatal(err)
+		}
+
+		var msg ws.WebsocketMsg
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("%s did not get %s: %s", c.username, msgType, err)
+		}
+
+		data, _ := msg.Content.Data.(map[string]interface{})
+		switch msg.Content.AppMsgType {
+		case msgType:
+			return data
+		case ws.Error:
+			c.t.Fatalf("%s got an error waiting for %s: %v", c.username, msgType, data)
+		}
+	}
+}
+
+// expectTokens collects the tokens sent to the trainer until the trade finishes
+func (c *tradeClient) expectTokens() []string {
+	c.t.Helper()
+
+	var received []string
+	for {
+		if err := c.conn.SetReadDeadline(time.Now().Add(tradeClientTimeout)); err != nil {
+			c.t.Fatal(err)
+		}
+
+		var msg ws.WebsocketMsg
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.t.Fatalf("%s did not get the trade finished: %s", c.username, err)
+		}
+
+		data, _ := msg.Content.Data.(map[string]interface{})
+		switch msg.Content.AppMsgType {
+		case ws.SetToken:
+			tokensString, _ := data["TokensString"].([]interface{})
+			for _, token := range tokensString {
+				received = append(received, token.(string))
+			}
+		case ws.Finish:
+			if success, _ := data["Success"].(bool); !success {
+				c.t.Fatalf("trade finished without success for %s", c.username)
+			}
+			return received
+		case ws.Error:
+			c.t.Fatalf("%s got an error waiting for the trade to finish: %v", c.username, data)
+		}
+	}
+}
+
+func (c *tradeClient) close() {
+	_ = c.conn.Close()
+}
+
+// everyone expects a message of the type given on every client
+func everyone(clients []*tradeClient, msgType string) {
+	for _, client := range clients {
+		client.expect(msgType)
+	}
+}
+
+func TestTradeOverWebsockets(t *testing.T) {
+	fakes, server, cleanup := setupTradeServer(t)
+	defer cleanup()
+
+	lobbyId := createTradeLobby(t, server, "ash", "misty")
+
+	ash := joinTradeLobby(t, server, lobbyId, fakeTokensHeader("ash", "ash-pikachu"))
+	defer ash.close()
+	misty := joinTradeLobby(t, server, lobbyId, fakeTokensHeader("misty", "misty-staryu"))
+	defer misty.close()
+
+	clients := []*tradeClient{ash, misty}
+	everyone(clients, trades.Start)
+	everyone(clients, Inventories)
+
+	ash.send(trades.Trade, TradeItemMessage{ItemId: "ash-potion"})
+	everyone(clients, trades.Update)
+	misty.send(trades.Trade, TradeItemMessage{ItemId: "misty-pokeball"})
+	everyone(clients, trades.Update)
+
+	ash.send(trades.Accept, trades.AcceptMessage{})
+	everyone(clients, trades.Update)
+	misty.send(trades.Accept, trades.AcceptMessage{})
+
+	for _, client := range clients {
+		received := client.expectTokens()
+		itemsToken := fakeItemsTokenPrefix + client.username
+		if !contains(received, itemsToken) {
+			t.Errorf("%s got tokens %q, expected %s among them", client.username, received, itemsToken)
+		}
+		client.close()
+	}
+
+	owned := inventories(t, fakes)
+	if _, ok := owned["ash"].Items["misty-pokeball"]; !ok || len(owned["ash"].Items) != 1 {
+		t.Errorf("ash owns items %v, expected only misty-pokeball", owned["ash"].Items)
+	}
+	if _, ok := owned["misty"].Items["ash-potion"]; !ok || len(owned["misty"].Items) != 1 {
+		t.Errorf("misty owns items %v, expected only ash-potion", owned["misty"].Items)
+	}
+	if len(owned["ash"].Pokemons) != 1 || len(owned["misty"].Pokemons) != 1 {
+		t.Error("pokemons changed owner without being traded")
+	}
+
+	expectNothingPending(t)
+}
+
+func TestJoinRejectedByRules(t *testing.T) {
+	_, server, cleanup := setupTradeServer(t)
+	defer cleanup()
+
+	config.Rules.MinTrainerLevel = 4
+	lobbyId := createTradeLobby(t, server, "ash", "misty")
+
+	ash := joinTradeLobby(t, server, lobbyId, fakeTokensHeader("ash"))
+	defer ash.close()
+
+	if code := ash.expect(ws.Error)["Code"]; code != string(codeTradeRuleViolated) {
+		t.Errorf("ash was rejected with %v, expected %s", code, codeTradeRuleViolated)
+	}
+}
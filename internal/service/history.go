@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type tradeOutcome string
+
+const (
+	tradeCompleted tradeOutcome = "COMPLETED"
+	tradeRejected  tradeOutcome = "REJECTED"
+	tradeTimedOut  tradeOutcome = "TIMED_OUT"
+	tradeFailed    tradeOutcome = "FAILED"
+)
+
+const (
+	historyStoreEnvVar = "TRADES_HISTORY_STORE"
+	supportTokenEnvVar = "TRADES_SUPPORT_TOKEN"
+	supportTokenHeader = "X-Support-Token"
+	outcomeQueryParam  = "outcome"
+
+	memoryHistoryStore = "memory"
+	mongoHistoryStore  = "mongo"
+
+	historyCollectionName = "TradeHistory"
+)
+
+// tradeRecord is what is kept of a lobby once it ends
+type tradeRecord struct {
+	LobbyId           string               `json:"lobby_id" bson:"_id"`
+	Trainers          []string             `json:"trainers" bson:"trainers"`
+	Outcome           tradeOutcome         `json:"outcome" bson:"outcome"`
+	Items             [][]items.Item       `json:"items" bson:"items"`
+	Pokemons          [][]pokemons.Pokemon `json:"pokemons" bson:"pokemons"`
+	ItemRecipients    []map[string]string  `json:"item_recipients" bson:"item_recipients"`
+	PokemonRecipients []map[string]string  `json:"pokemon_recipients" bson:"pokemon_recipients"`
+	Coins             []int                `json:"coins" bson:"coins"`
+	CoinsRecipients   []string             `json:"coins_recipients" bson:"coins_recipients"`
+	CreatedAt         time.Time            `json:"created_at" bson:"created_at"`
+	FinishedAt        time.Time            `json:"finished_at" bson:"finished_at"`
+}
+
+// tradeHistoryEntry is a trade record seen from one of its trainers. Counterparty is the first
+// of the counterparties, which is the only one in trades between two trainers.
+type tradeHistoryEntry struct {
+	LobbyId          string             `json:"lobby_id"`
+	Counterparty     string             `json:"counterparty"`
+	Counterparties   []string           `json:"counterparties"`
+	Outcome          tradeOutcome       `json:"outcome"`
+	ItemsGiven       []items.Item       `json:"items_given"`
+	ItemsReceived    []items.Item       `json:"items_received"`
+	PokemonsGiven    []pokemons.Pokemon `json:"pokemons_given"`
+	PokemonsReceived []pokemons.Pokemon `json:"pokemons_received"`
+	CoinsGiven       int                `json:"coins_given"`
+	CoinsReceived    int                `json:"coins_received"`
+	CreatedAt        time.Time          `json:"created_at"`
+	FinishedAt       time.Time          `json:"finished_at"`
+}
+
+// tradeHistory keeps the records of the trades that ended, most recent first when listed.
+// An empty outcome lists every outcome.
+type tradeHistory interface {
+	Add(record *tradeRecord) error
+	ListByTrainer(username string, outcome tradeOutcome) ([]*tradeRecord, error)
+}
+
+var validOutcomes = map[tradeOutcome]bool{
+	tradeCompleted: true,
+	tradeRejected:  true,
+	tradeTimedOut:  true,
+	tradeFailed:    true,
+}
+
+func newTradeHistoryFromEnv() (tradeHistory, error) {
+	storeType, exists := os.LookupEnv(historyStoreEnvVar)
+	if !exists {
+		storeType = memoryHistoryStore
+	}
+
+	switch storeType {
+	case memoryHistoryStore:
+		return &memoryHistory{}, nil
+	case mongoHistoryStore:
+		url, exists := os.LookupEnv(mongoURLEnvVar)
+		if !exists {
+			return nil, errorNoMongoURL
+		}
+		return newMongoHistory(url)
+	default:
+		return nil, newInvalidHistoryStoreError(storeType)
+	}
+}
+
+// recordTradeOutcome adds the lobby to the history. Failing to do so does not affect the trade,
+// so errors are only logged.
+func recordTradeOutcome(lobby *tradeLobby, outcome tradeOutcome) {
+	trainers := lobby.participants()
+	record := &tradeRecord{
+		LobbyId:           lobby.wsLobby.Id,
+		Trainers:          trainers,
+		Outcome:           outcome,
+		Items:             make([][]items.Item, len(trainers)),
+		Pokemons:          make([][]pokemons.Pokemon, len(trainers)),
+		ItemRecipients:    make([]map[string]string, len(trainers)),
+		PokemonRecipients: make([]map[string]string, len(trainers)),
+		Coins:             make([]int, len(trainers)),
+		CoinsRecipients:   make([]string, len(trainers)),
+		CreatedAt:         lobby.createdAt,
+		FinishedAt:        time.Now(),
+	}
+
+	for i := range trainers {
+		record.Items[i] = []items.Item{}
+		record.Pokemons[i] = []pokemons.Pokemon{}
+		if lobby.status != nil {
+			player := lobby.status.Players[i]
+			record.Items[i] = player.Items
+			record.Pokemons[i] = player.Pokemons
+			record.ItemRecipients[i] = player.ItemRecipients
+			record.PokemonRecipients[i] = player.PokemonRecipients
+			record.Coins[i] = player.Coins
+			record.CoinsRecipients[i] = player.CoinsRecipient
+		}
+	}
+
+	if err := history.Add(record); err != nil {
+		log.Error(wrapTradeHistoryError(err))
+	}
+
+	finished := map[string]interface{}{"outcome": outcome}
+	if lobby.status != nil {
+		finished["status"] = lobby.status
+	}
+	recordAuditEvent(lobby.wsLobby.Id, auditTradeFinished, "", finished, nil)
+}
+
+func (record *tradeRecord) toHistoryEntry(username string) tradeHistoryEntry {
+	entry := tradeHistoryEntry{
+		LobbyId:          record.LobbyId,
+		Counterparties:   []string{},
+		Outcome:          record.Outcome,
+		ItemsGiven:       []items.Item{},
+		ItemsReceived:    []items.Item{},
+		PokemonsGiven:    []pokemons.Pokemon{},
+		PokemonsReceived: []pokemons.Pokemon{},
+		CreatedAt:        record.CreatedAt,
+		FinishedAt:       record.FinishedAt,
+	}
+
+	trainerNum := 0
+	for i, trainer := range record.Trainers {
+		if trainer == username {
+			trainerNum = i
+		} else {
+			entry.Counterparties = append(entry.Counterparties, trainer)
+		}
+	}
+
+	if len(entry.Counterparties) > 0 {
+		entry.Counterparty = entry.Counterparties[0]
+	}
+
+	for giver := range record.Trainers {
+		if giver == trainerNum {
+			entry.ItemsGiven = append(entry.ItemsGiven, record.Items[giver]...)
+			entry.PokemonsGiven = append(entry.PokemonsGiven, record.Pokemons[giver]...)
+			if giver < len(record.Coins) {
+				entry.CoinsGiven = record.Coins[giver]
+			}
+			continue
+		}
+
+		if giver < len(record.Coins) && record.Coins[giver] > 0 &&
+			coinsRecipient(record.Trainers, record.CoinsRecipients, giver) == trainerNum {
+			entry.CoinsReceived += record.Coins[giver]
+		}
+
+		for _, item := range record.Items[giver] {
+			if transferRecipient(record.Trainers, record.ItemRecipients, giver, item.Id) == trainerNum {
+				entry.ItemsReceived = append(entry.ItemsReceived, item)
+			}
+		}
+
+		for _, pokemon := range record.Pokemons[giver] {
+			if transferRecipient(record.Trainers, record.PokemonRecipients, giver, pokemon.Id) == trainerNum {
+				entry.PokemonsReceived = append(entry.PokemonsReceived, pokemon)
+			}
+		}
+	}
+
+	return entry
+}
+
+// memoryHistory is the default store. It keeps every record it is given until restarted, so
+// deployments that want a lasting history have to pick the mongo store.
+type memoryHistory struct {
+	records []*tradeRecord
+	lock    sync.RWMutex
+}
+
+func (h *memoryHistory) Add(record *tradeRecord) error {
+	h.lock.Lock()
+	h.records = append(h.records, record)
+	h.lock.Unlock()
+	return nil
+}
+
+func (h *memoryHistory) ListByTrainer(username string, outcome tradeOutcome) ([]*tradeRecord, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	var records []*tradeRecord
+	for _, record := range h.records {
+		if !contains(record.Trainers, username) {
+			continue
+		}
+
+		if outcome != "" && record.Outcome != outcome {
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].FinishedAt.After(records[j].FinishedAt)
+	})
+
+	return records, nil
+}
+
+type mongoHistory struct {
+	collection *mongo.Collection
+}
+
+func newMongoHistory(url string) (*mongoHistory, error) {
+	collection, err := getMongoCollection(url, historyCollectionName)
+	if err != nil {
+		return nil, wrapTradeHistoryError(err)
+	}
+
+	return &mongoHistory{collection: collection}, nil
+}
+
+func (h *mongoHistory) Add(record *tradeRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := h.collection.InsertOne(ctx, record)
+	if err != nil {
+		return wrapTradeHistoryError(err)
+	}
+
+	return nil
+}
+
+func (h *mongoHistory) ListByTrainer(username string, outcome tradeOutcome) ([]*tradeRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	filter := bson.M{"trainers": username}
+	if outcome != "" {
+		filter["outcome"] = outcome
+	}
+
+	cursor, err := h.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"finished_at": -1}))
+	if err != nil {
+		return nil, wrapTradeHistoryError(err)
+	}
+
+	var records []*tradeRecord
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, wrapTradeHistoryError(err)
+	}
+
+	return records, nil
+}
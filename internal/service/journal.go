@@ -0,0 +1,274 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	log "github.com/sirupsen/logrus"
+)
+
+type journalState string
+
+const (
+	journalPreparing   journalState = "PREPARING"
+	journalApplying    journalState = "APPLYING"
+	journalRollingBack journalState = "ROLLING_BACK"
+)
+
+const (
+	journalBackendEnvVar = "TRADES_JOURNAL_BACKEND"
+	journalDirEnvVar     = "TRADES_JOURNAL_DIR"
+
+	fileJournalBackend = "file"
+	defaultJournalDir  = "trades_journal"
+
+	journalFileExtension = ".json"
+)
+
+// journalEntry holds everything needed to finish or undo a commit without the lobby or trade offer
+// that originated it, whose id is kept as LobbyId. Started counts the commit steps that may have
+// been applied. Entries recorded before trades had recipients have none, which means each item goes
+// to the other trainer. Balances are the coins of each trainer before the commit, and are left
+// empty when no coins are exchanged. AuthTokens are the ones the trainers joined with, which
+// recovery needs since the trainers service has no other way to authorize the changes. They are
+// why the journal directory is only readable by the service.
+type journalEntry struct {
+	LobbyId           string
+	Trainers          []string
+	Items             [][]items.Item
+	Pokemons          [][]pokemons.Pokemon
+	ItemRecipients    []map[string]string
+	PokemonRecipients []map[string]string
+	Coins             []int
+	CoinsRecipients   []string
+	Balances          []int
+	AuthTokens        []string
+	State             journalState
+	Started           int
+	UpdatedAt         time.Time
+}
+
+// tradeJournal is a write-ahead log of the commits in progress. Entries are recorded before each
+// commit step and removed once the commit is either fully applied or fully rolled back.
+type tradeJournal interface {
+	Record(entry *journalEntry) error
+	Remove(lobbyId string) error
+	Pending() ([]*journalEntry, error)
+}
+
+func newJournalEntry(lobby *tradeLobby) *journalEntry {
+	lobby.tokensLock.Lock()
+	authTokens := append([]string{}, lobby.authTokens...)
+	lobby.tokensLock.Unlock()
+
+	entry := &journalEntry{
+		LobbyId:    lobby.wsLobby.Id,
+		Trainers:   lobby.trainers,
+		AuthTokens: authTokens,
+		State:      journalPreparing,
+	}
+
+	for _, player := range lobby.status.Players {
+		entry.Items = append(entry.Items, player.Items)
+		entry.Pokemons = append(entry.Pokemons, player.Pokemons)
+		entry.ItemRecipients = append(entry.ItemRecipients, player.ItemRecipients)
+		entry.PokemonRecipients = append(entry.PokemonRecipients, player.PokemonRecipients)
+	}
+
+	if tradedCoins(lobby.status) {
+		for trainerNum, player := range lobby.status.Players {
+			entry.Coins = append(entry.Coins, player.Coins)
+			entry.CoinsRecipients = append(entry.CoinsRecipients, player.CoinsRecipient)
+			entry.Balances = append(entry.Balances, lobby.initialStats[trainerNum].Coins)
+		}
+	}
+
+	return entry
+}
+
+func newTradeJournalFromEnv() (tradeJournal, error) {
+	backend, exists := os.LookupEnv(journalBackendEnvVar)
+	if !exists {
+		backend = fileJournalBackend
+	}
+
+	switch backend {
+	case fileJournalBackend:
+		dir, exists := os.LookupEnv(journalDirEnvVar)
+		if !exists {
+			dir = defaultJournalDir
+		}
+		return newFileJournal(dir)
+	default:
+		return nil, newInvalidJournalBackendError(backend)
+	}
+}
+
+// recoverPendingTrades goes through the commits left in the journal by a previous run. A commit
+// whose steps were all applied is considered finished, any other is rolled back, using the auth
+// tokens recorded with each entry.
+func recoverPendingTrades(trainersClient trainersService) error {
+	entries, err := journal.Pending()
+	if err != nil {
+		return wrapRecoverTradesError(err)
+	}
+
+	for _, entry := range entries {
+		if err = recoverTrade(trainersClient, entry); err != nil {
+			log.Error(wrapRecoverTradesError(err))
+		}
+	}
+
+	return nil
+}
+
+func recoverTrade(trainersClient trainersService, entry *journalEntry) error {
+	// entries recorded without tokens have the changes tried without them
+	authTokens := make([]string, len(entry.Trainers))
+	copy(authTokens, entry.AuthTokens)
+	steps := buildCommitSteps(trainersClient, entry, authTokens)
+
+	switch entry.State {
+	case journalApplying:
+		if entry.Started == len(steps) {
+			finished, err := allStepsApplied(steps)
+			if err != nil {
+				return err
+			}
+
+			if finished {
+				log.Infof("trade %s was fully committed before restarting", entry.LobbyId)
+				recordAuditEvent(entry.LobbyId, auditCommitRecovered, "",
+					map[string]interface{}{"state": entry.State, "committed": true}, nil)
+				break
+			}
+		}
+		fallthrough
+	case journalRollingBack:
+		log.Warnf("rolling back trade %s left in state %s", entry.LobbyId, entry.State)
+		err := rollbackSteps(steps[:entry.Started])
+		recordAuditEvent(entry.LobbyId, auditCommitRecovered, "",
+			map[string]interface{}{"state": entry.State, "committed": false}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return journal.Remove(entry.LobbyId)
+}
+
+func allStepsApplied(steps []commitStep) (bool, error) {
+	for _, step := range steps {
+		applied, err := step.applied()
+		if err != nil || !applied {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// fileJournal keeps one JSON file per lobby in a directory. Files are replaced atomically so
+// a crash while recording never leaves a partially written entry.
+type fileJournal struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func newFileJournal(dir string) (*fileJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, wrapJournalError(err)
+	}
+
+	return &fileJournal{dir: dir}, nil
+}
+
+func (j *fileJournal) Record(entry *journalEntry) error {
+	entry.UpdatedAt = time.Now()
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return wrapJournalError(err)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	tmpFile, err := ioutil.TempFile(j.dir, entry.LobbyId)
+	if err != nil {
+		return wrapJournalError(err)
+	}
+
+	_, err = tmpFile.Write(entryBytes)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), j.entryPath(entry.LobbyId))
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return wrapJournalError(err)
+	}
+
+	return nil
+}
+
+func (j *fileJournal) Remove(lobbyId string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	err := os.Remove(j.entryPath(lobbyId))
+	if err != nil && !os.IsNotExist(err) {
+		return wrapJournalError(err)
+	}
+
+	return nil
+}
+
+func (j *fileJournal) Pending() ([]*journalEntry, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return nil, wrapJournalError(err)
+	}
+
+	var entries []*journalEntry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), journalFileExtension) {
+			continue
+		}
+
+		entryBytes, err := ioutil.ReadFile(filepath.Join(j.dir, file.Name()))
+		if err != nil {
+			return nil, wrapJournalError(err)
+		}
+
+		entry := &journalEntry{}
+		if err = json.Unmarshal(entryBytes, entry); err != nil {
+			return nil, wrapJournalError(err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (j *fileJournal) entryPath(lobbyId string) string {
+	return filepath.Join(j.dir, lobbyId+journalFileExtension)
+}
@@ -0,0 +1,611 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/api"
+	"github.com/NOVAPokemon/utils/tokens"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+	"github.com/gorilla/websocket"
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of simulated trades
+const (
+	loadAccept = "accept"
+	loadReject = "reject"
+)
+
+// Outcomes of simulated trades
+const (
+	loadCompleted = "completed"
+	loadRejected  = "rejected"
+	loadFailed    = "failed"
+)
+
+// Stages whose latencies are reported
+const (
+	loadStageCreate = "create"
+	loadStageJoin   = "join"
+	loadStageReject = "reject"
+	loadStageTrade  = "trade"
+)
+
+const (
+	defaultLoadConcurrency  = 10
+	defaultLoadTradeTimeout = duration(time.Minute)
+)
+
+// loadScenario is read from the file given to loadgen. Trainers are simulated in pairs, one pair
+// per concurrent trade, with the headers in the trainers file, which maps usernames to the tokens
+// they join trades with. Trades started are spread over the kinds in the mix by weight and
+// limited to Rate per second, if set.
+//
+// A pair plays one trade at a time and keeps the tokens the service sends when a trade commits,
+// so with OfferItems a pair can keep trading. Concurrency is capped by the number of pairs the
+// trainers file has, since no trainer is in two trades at once.
+type loadScenario struct {
+	Target       string   `json:"target"`
+	TrainersFile string   `json:"trainers_file"`
+	Trades       int      `json:"trades"`
+	Concurrency  int      `json:"concurrency"`
+	Rate         float64  `json:"rate"`
+	Mix          loadMix  `json:"mix"`
+	OfferItems   bool     `json:"offer_items"`
+	TradeTimeout duration `json:"trade_timeout"`
+}
+
+// loadMix weighs the kinds of trades. In accepted trades both trainers join, offer what they
+// want and accept, while in rejected ones the invited trainer rejects the invite.
+type loadMix struct {
+	Accept int `json:"accept"`
+	Reject int `json:"reject"`
+}
+
+// latencySummary has the percentiles of how long a stage took
+type latencySummary struct {
+	Count int      `json:"count"`
+	P50   duration `json:"p50"`
+	P90   duration `json:"p90"`
+	P99   duration `json:"p99"`
+	Max   duration `json:"max"`
+}
+
+// loadReport counts failures by error code when the service sent one, or else by where the
+// simulated trade failed
+type loadReport struct {
+	Trades     int                       `json:"trades"`
+	Elapsed    duration                  `json:"elapsed"`
+	Throughput float64                   `json:"throughput"`
+	Outcomes   map[string]int            `json:"outcomes"`
+	Failures   map[string]int            `json:"failures"`
+	Latencies  map[string]latencySummary `json:"latencies"`
+}
+
+type simulatedTrainer struct {
+	username string
+	header   http.Header
+}
+
+// loadRecorder gathers what simulated trades report, from every worker
+type loadRecorder struct {
+	latencies map[string][]time.Duration
+	outcomes  map[string]int
+	failures  map[string]int
+	lock      sync.Mutex
+}
+
+func newLoadRecorder() *loadRecorder {
+	return &loadRecorder{
+		latencies: map[string][]time.Duration{},
+		outcomes:  map[string]int{},
+		failures:  map[string]int{},
+	}
+}
+
+func (r *loadRecorder) latency(stage string, since time.Time) {
+	r.lock.Lock()
+	r.latencies[stage] = append(r.latencies[stage], time.Since(since))
+	r.lock.Unlock()
+}
+
+func (r *loadRecorder) outcome(outcome string) {
+	r.lock.Lock()
+	r.outcomes[outcome]++
+	r.lock.Unlock()
+}
+
+func (r *loadRecorder) failure(reason string) {
+	r.lock.Lock()
+	r.outcomes[loadFailed]++
+	r.failures[reason]++
+	r.lock.Unlock()
+}
+
+func (r *loadRecorder) report(trades int, elapsed time.Duration) *loadReport {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	report := &loadReport{
+		Trades:     trades,
+		Elapsed:    duration(elapsed),
+		Throughput: float64(trades) / elapsed.Seconds(),
+		Outcomes:   r.outcomes,
+		Failures:   r.failures,
+		Latencies:  map[string]latencySummary{},
+	}
+
+	for stage, latencies := range r.latencies {
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+
+		report.Latencies[stage] = latencySummary{
+			Count: len(latencies),
+			P50:   duration(percentile(latencies, 50)),
+			P90:   duration(percentile(latencies, 90)),
+			P99:   duration(percentile(latencies, 99)),
+			Max:   duration(latencies[len(latencies)-1]),
+		}
+	}
+
+	return report
+}
+
+// percentile takes the latencies sorted
+func percentile(latencies []time.Duration, p int) time.Duration {
+	return latencies[(len(latencies)-1)*p/100]
+}
+
+// RunLoad simulates the trades of the scenario through the HTTP and websocket routes of the
+// target and writes the report to out
+func RunLoad(scenarioFile string, out io.Writer) error {
+	scenario, err := loadScenarioFromFile(scenarioFile)
+	if err != nil {
+		return wrapLoadError(err)
+	}
+
+	pairs, err := loadTrainerPairs(scenario.TrainersFile, scenario.Concurrency)
+	if err != nil {
+		return wrapLoadError(err)
+	}
+
+	report := scenario.run(utils.CreateDefaultCommunicationManager(), pairs)
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		return wrapLoadError(err)
+	}
+
+	return nil
+}
+
+func loadScenarioFromFile(scenarioFile string) (*loadScenario, error) {
+	scenarioBytes, err := ioutil.ReadFile(scenarioFile)
+	if err != nil {
+		return nil, err
+	}
+
+	scenario := &loadScenario{
+		Concurrency:  defaultLoadConcurrency,
+		Mix:          loadMix{Accept: 1},
+		TradeTimeout: defaultLoadTradeTimeout,
+	}
+	if err = json.Unmarshal(scenarioBytes, scenario); err != nil {
+		return nil, err
+	}
+
+	if err = scenario.validate(); err != nil {
+		return nil, err
+	}
+
+	return scenario, nil
+}
+
+func (s *loadScenario) validate() error {
+	if s.Target == "" {
+		return newInvalidConfigError("load.target", "must be set")
+	}
+
+	if s.Trades <= 0 {
+		return newInvalidConfigError("load.trades", "must be positive")
+	}
+
+	if s.Concurrency <= 0 {
+		return newInvalidConfigError("load.concurrency", "must be positive")
+	}
+
+	if s.Rate < 0 {
+		return newInvalidConfigError("load.rate", "must not be negative")
+	}
+
+	if s.Mix.Accept < 0 || s.Mix.Reject < 0 || s.Mix.Accept+s.Mix.Reject == 0 {
+		return newInvalidConfigError("load.mix", "weights must not be negative and one must be positive")
+	}
+
+	if s.TradeTimeout <= 0 {
+		return newInvalidConfigError("load.trade_timeout", "must be positive")
+	}
+
+	return nil
+}
+
+// loadTrainerPairs takes trainers in username order, so runs with the same file pair them alike.
+// Header names are made canonical, so tokens received after a trade replace the ones loaded.
+func loadTrainerPairs(trainersFile string, numPairs int) ([][2]simulatedTrainer, error) {
+	trainersBytes, err := ioutil.ReadFile(trainersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]http.Header{}
+	if err = json.Unmarshal(trainersBytes, &headers); err != nil {
+		return nil, err
+	}
+
+	if len(headers) < 2*numPairs {
+		return nil, newNotEnoughTrainersError(len(headers), 2*numPairs)
+	}
+
+	usernames := make([]string, 0, len(headers))
+	for username := range headers {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	pairs := make([][2]simulatedTrainer, numPairs)
+	for i := range pairs {
+		for j := range pairs[i] {
+			username := usernames[2*i+j]
+			header := http.Header{}
+			for name, values := range headers[username] {
+				for _, value := range values {
+					header.Add(name, value)
+				}
+			}
+			pairs[i][j] = simulatedTrainer{username: username, header: header}
+		}
+	}
+
+	return pairs, nil
+}
+
+// run gives each pair its own worker, taking the kinds of trade to simulate as they are started
+func (s *loadScenario) run(manager ws.CommunicationManager, pairs [][2]simulatedTrainer) *loadReport {
+	recorder := newLoadRecorder()
+	kinds := make(chan string)
+
+	wg := sync.WaitGroup{}
+	for _, pair := range pairs {
+		wg.Add(1)
+		go func(pair [2]simulatedTrainer) {
+			defer wg.Done()
+			for kind := range kinds {
+				s.simulateTrade(manager, pair, kind, recorder)
+			}
+		}(pair)
+	}
+
+	var ticker *time.Ticker
+	if s.Rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / s.Rate))
+		defer ticker.Stop()
+	}
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	start := time.Now()
+	for i := 0; i < s.Trades; i++ {
+		if ticker != nil {
+			<-ticker.C
+		}
+
+		kind := loadAccept
+		if random.Intn(s.Mix.Accept+s.Mix.Reject) >= s.Mix.Accept {
+			kind = loadReject
+		}
+		kinds <- kind
+	}
+	close(kinds)
+
+	wg.Wait()
+	return recorder.report(s.Trades, time.Since(start))
+}
+
+// simulateTrade has the first trainer of the pair invite the second one
+func (s *loadScenario) simulateTrade(manager ws.CommunicationManager, pair [2]simulatedTrainer, kind string,
+	recorder *loadRecorder) {
+	start := time.Now()
+	creator, invited := pair[0], pair[1]
+
+	lobbyId, reason := s.createLobby(creator, invited.username)
+	if reason != "" {
+		recorder.failure(reason)
+		return
+	}
+	recorder.latency(loadStageCreate, start)
+
+	deadline := start.Add(time.Duration(s.TradeTimeout))
+	conns := make([]*websocket.Conn, 0, len(pair))
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+
+	joining := []simulatedTrainer{creator}
+	if kind == loadAccept {
+		joining = append(joining, invited)
+	}
+
+	for _, trainer := range joining {
+		joinStart := time.Now()
+		conn, err := s.joinLobby(trainer, lobbyId)
+		if err != nil {
+			log.Warn(wrapLoadError(err))
+			recorder.failure(loadStageJoin)
+			return
+		}
+		recorder.latency(loadStageJoin, joinStart)
+		conns = append(conns, conn)
+	}
+
+	if kind == loadReject {
+		rejectStart := time.Now()
+		if reason = s.rejectLobby(invited, lobbyId); reason != "" {
+			recorder.failure(reason)
+			return
+		}
+		recorder.latency(loadStageReject, rejectStart)
+
+		// the creator is only told the trade is over
+		if _, reason = playTrade(manager, conns[0], creator, deadline, false); reason != "" {
+			recorder.failure(reason)
+			return
+		}
+		recorder.latency(loadStageTrade, start)
+		recorder.outcome(loadRejected)
+		return
+	}
+
+	reasons := make([]string, len(conns))
+	successes := make([]bool, len(conns))
+	wg := sync.WaitGroup{}
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+			successes[i], reasons[i] = playTrade(manager, conn, joining[i], deadline, s.OfferItems)
+		}(i, conn)
+	}
+	wg.Wait()
+
+	for i, reason := range reasons {
+		if reason == "" && !successes[i] {
+			reason = string(codeCommitFailed)
+		}
+
+		if reason != "" {
+			recorder.failure(reason)
+			return
+		}
+	}
+
+	recorder.latency(loadStageTrade, start)
+	recorder.outcome(loadCompleted)
+}
+
+func (s *loadScenario) url(scheme, path string) string {
+	return fmt.Sprintf("%s://%s%s", scheme, s.Target, path)
+}
+
+// createLobby gives the lobby id, or the reason it was not created
+func (s *loadScenario) createLobby(creator simulatedTrainer, invited string) (string, string) {
+	requestBytes, err := json.Marshal(api.CreateLobbyRequest{Username: invited})
+	if err != nil {
+		return "", loadFailure(loadStageCreate, err)
+	}
+
+	req, err := http.NewRequest(post, s.url("http", api.StartTradePath), bytes.NewReader(requestBytes))
+	if err != nil {
+		return "", loadFailure(loadStageCreate, err)
+	}
+	req.Header = creator.header.Clone()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", loadFailure(loadStageCreate, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", responseFailure(loadStageCreate, resp)
+	}
+
+	lobby := api.CreateLobbyResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(&lobby); err != nil {
+		return "", loadFailure(loadStageCreate, err)
+	}
+
+	return lobby.LobbyId, ""
+}
+
+func (s *loadScenario) joinLobby(trainer simulatedTrainer, lobbyId string) (*websocket.Conn, error) {
+	path := strings.Replace(api.JoinTradeRoute, "{"+api.TradeIdVar+"}", lobbyId, 1)
+	conn, _, err := websocket.DefaultDialer.Dial(s.url("ws", path), trainer.header)
+	return conn, err
+}
+
+func (s *loadScenario) rejectLobby(trainer simulatedTrainer, lobbyId string) string {
+	path := strings.Replace(api.RejectTradeRoute, "{"+api.TradeIdVar+"}", lobbyId, 1)
+	req, err := http.NewRequest(post, s.url("http", path), nil)
+	if err != nil {
+		return loadFailure(loadStageReject, err)
+	}
+	req.Header = trainer.header.Clone()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return loadFailure(loadStageReject, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseFailure(loadStageReject, resp)
+	}
+
+	return ""
+}
+
+// loadFailure logs the error and reports it by stage, so failures are counted in few reasons
+func loadFailure(stage string, err error) string {
+	log.Warn(wrapLoadError(err))
+	return stage
+}
+
+// responseFailure is the error code in the response body, if the service sent one
+func responseFailure(stage string, resp *http.Response) string {
+	body := httpErrorBody{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Code == "" {
+		return fmt.Sprintf("%s status %d", stage, resp.StatusCode)
+	}
+
+	return string(body.Code)
+}
+
+// playTrade acts as the trainer until the trade finishes or is rejected, accepting whenever the
+// trade changes and confirming when told the trade is lopsided. Tokens sent once the trade
+// commits replace the ones in the header of the trainer. The reason is empty unless the trainer
+// failed to see the trade end.
+func playTrade(manager ws.CommunicationManager, conn *websocket.Conn, trainer simulatedTrainer,
+	deadline time.Time, offerItems bool) (success bool, reason string) {
+	username := trainer.username
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return false, loadFailure(loadStageTrade, err)
+	}
+
+	send := func(msgType string, data interface{}) bool {
+		return manager.WriteGenericMessageToConn(conn, ws.NewRequestMsg(msgType, data)) == nil
+	}
+
+	trade := &tradeStatus{}
+	var tokenHeaders []string
+
+	for {
+		msg, err := manager.ReadMessageFromConn(conn)
+		if err != nil {
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				return false, "timeout"
+			}
+			return false, "connection closed"
+		}
+
+		if msg.Content == nil {
+			continue
+		}
+
+		switch msg.Content.AppMsgType {
+		case Inventories:
+			inventories := InventoriesMessage{}
+			if err = mapstructure.Decode(msg.Content.Data, &inventories); err != nil {
+				return false, loadFailure(loadStageTrade, err)
+			}
+
+			offered := false
+			for _, assets := range inventories.Trainers {
+				if offerItems && assets.Username == username && len(assets.Items) > 0 {
+					offered = send(trades.Trade, TradeItemMessage{ItemId: assets.Items[0].Id})
+				}
+			}
+
+			if !offered && !send(trades.Accept, trades.AcceptMessage{}) {
+				return false, "connection closed"
+			}
+		case trades.Update:
+			update := UpdateMessage{}
+			if err = mapstructure.Decode(msg.Content.Data, &update); err != nil {
+				return false, loadFailure(loadStageTrade, err)
+			}
+			trade = &update.TradeStatus
+
+			for _, player := range update.TradeStatus.Players {
+				if player.Username != username {
+					continue
+				}
+
+				if !player.Accepted {
+					send(trades.Accept, trades.AcceptMessage{})
+				} else if player.Disadvantaged && !player.Confirmed {
+					send(ConfirmTrade, nil)
+				}
+			}
+		case ws.Error:
+			errorMsg := ErrorTradeMessage{}
+			if err = mapstructure.Decode(msg.Content.Data, &errorMsg); err != nil {
+				return false, loadFailure(loadStageTrade, err)
+			}
+
+			if errorMsg.Fatal {
+				return false, string(errorMsg.Code)
+			}
+			log.Warnf("load trainer %s got %s: %s", username, errorMsg.Code, errorMsg.Info)
+		case ws.SetToken:
+			setToken := ws.SetTokenMessage{}
+			if err = mapstructure.Decode(msg.Content.Data, &setToken); err != nil {
+				return false, loadFailure(loadStageTrade, err)
+			}
+
+			if tokenHeaders == nil {
+				tokenHeaders = updatedTokenHeaders(trade, trainer.header)
+			}
+
+			if len(tokenHeaders) == 0 {
+				log.Warnf("load trainer %s got more tokens than the trade changed", username)
+				continue
+			}
+
+			trainer.header.Del(tokenHeaders[0])
+			for _, token := range setToken.TokensString {
+				trainer.header.Add(tokenHeaders[0], token)
+			}
+			tokenHeaders = tokenHeaders[1:]
+		case trades.Reject:
+			return false, ""
+		case ws.Finish:
+			finishMsg := ws.FinishMessage{}
+			if err = mapstructure.Decode(msg.Content.Data, &finishMsg); err != nil {
+				return false, loadFailure(loadStageTrade, err)
+			}
+
+			return finishMsg.Success, ""
+		}
+	}
+}
+
+// updatedTokenHeaders lists the headers of the tokens a trainer is sent once the trade commits,
+// in the order sendUpdatedTokens sends them, as the tokens do not say what they are for
+func updatedTokenHeaders(trade *tradeStatus, header http.Header) []string {
+	names := []string{tokens.ItemsTokenHeaderName}
+	if tradedCoins(trade) && header.Get(tokens.StatsTokenHeaderName) != "" {
+		names = append(names, tokens.StatsTokenHeaderName)
+	}
+
+	if tradedPokemons(trade) {
+		names = append(names, tokens.PokemonsTokenHeaderName)
+	}
+
+	return names
+}
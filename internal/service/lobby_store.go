@@ -0,0 +1,329 @@
+package service
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type lobbyState string
+
+const (
+	lobbyWaiting lobbyState = "WAITING"
+	lobbyOngoing lobbyState = "ONGOING"
+)
+
+const (
+	lobbyStoreEnvVar = "TRADES_LOBBY_STORE"
+
+	memoryLobbyStore = "memory"
+	mongoLobbyStore  = "mongo"
+
+	lobbiesCollectionName = "TradeLobbies"
+)
+
+// lobbyStore keeps the lobbies of this replica while they wait for both trainers to join and
+// while the trade is ongoing. Owner tells which replica holds a lobby, as far as the store knows.
+type lobbyStore interface {
+	Create(lobby *tradeLobby) error
+	Get(lobbyId string) (*tradeLobby, lobbyState, bool)
+	Start(lobbyId string) error
+	Delete(lobbyId string) error
+	List(state lobbyState) []*tradeLobby
+	Owner(lobbyId string) (string, bool, error)
+}
+
+func newLobbyStoreFromEnv() (lobbyStore, error) {
+	storeType, exists := os.LookupEnv(lobbyStoreEnvVar)
+	if !exists {
+		storeType = memoryLobbyStore
+	}
+
+	switch storeType {
+	case memoryLobbyStore:
+		if config.ProxyJoins {
+			return nil, errorProxyNeedsSharedStore
+		}
+		return newMemoryLobbyStore(), nil
+	case mongoLobbyStore:
+		url, exists := os.LookupEnv(mongoURLEnvVar)
+		if !exists {
+			return nil, errorNoMongoURL
+		}
+		return newMongoLobbyStore(url)
+	default:
+		return nil, newInvalidLobbyStoreError(storeType)
+	}
+}
+
+type memoryStore struct {
+	waitingTrades sync.Map
+	ongoingTrades sync.Map
+}
+
+func newMemoryLobbyStore() *memoryStore {
+	return &memoryStore{
+		waitingTrades: sync.Map{},
+		ongoingTrades: sync.Map{},
+	}
+}
+
+func (s *memoryStore) Create(lobby *tradeLobby) error {
+	s.waitingTrades.Store(lobby.wsLobby.Id, lobby)
+	return nil
+}
+
+func (s *memoryStore) Get(lobbyId string) (*tradeLobby, lobbyState, bool) {
+	if value, ok := s.ongoingTrades.Load(lobbyId); ok {
+		return value.(*tradeLobby), lobbyOngoing, true
+	}
+
+	if value, ok := s.waitingTrades.Load(lobbyId); ok {
+		return value.(*tradeLobby), lobbyWaiting, true
+	}
+
+	return nil, "", false
+}
+
+func (s *memoryStore) Start(lobbyId string) error {
+	value, ok := s.waitingTrades.Load(lobbyId)
+	if !ok {
+		return newTradeLobbyNotFoundError(lobbyId)
+	}
+
+	s.waitingTrades.Delete(lobbyId)
+	s.ongoingTrades.Store(lobbyId, value)
+	return nil
+}
+
+func (s *memoryStore) Delete(lobbyId string) error {
+	s.waitingTrades.Delete(lobbyId)
+	s.ongoingTrades.Delete(lobbyId)
+	return nil
+}
+
+func (s *memoryStore) List(state lobbyState) []*tradeLobby {
+	trades := &s.waitingTrades
+	if state == lobbyOngoing {
+		trades = &s.ongoingTrades
+	}
+
+	var lobbies []*tradeLobby
+	trades.Range(func(key, value interface{}) bool {
+		lobbies = append(lobbies, value.(*tradeLobby))
+		return true
+	})
+
+	return lobbies
+}
+
+// Owner only knows about the lobbies of this replica, which is why proxying joins needs a shared store
+func (s *memoryStore) Owner(lobbyId string) (string, bool, error) {
+	_, _, ok := s.Get(lobbyId)
+	if !ok {
+		return "", false, nil
+	}
+
+	return serverName, true, nil
+}
+
+type lobbyDocument struct {
+	Id         string     `bson:"_id"`
+	Trainers   []string   `bson:"trainers"`
+	State      lobbyState `bson:"state"`
+	ServerName string     `bson:"server_name"`
+	CreatedAt  time.Time  `bson:"created_at"`
+}
+
+// lobbyDirectory holds the metadata of the lobbies of every replica, so any of them can tell
+// which replica owns a lobby
+type lobbyDirectory interface {
+	Register(document lobbyDocument) error
+	SetState(lobbyId string, state lobbyState) error
+	Remove(lobbyId string) error
+	Find(lobbyId string) (*lobbyDocument, bool, error)
+}
+
+// sharedStore keeps the live lobbies in memory, since they hold connections and channels, and
+// writes through their metadata to a directory shared by all replicas.
+type sharedStore struct {
+	*memoryStore
+	directory  lobbyDirectory
+	serverName string
+}
+
+func newSharedLobbyStore(directory lobbyDirectory, serverName string) *sharedStore {
+	return &sharedStore{
+		memoryStore: newMemoryLobbyStore(),
+		directory:   directory,
+		serverName:  serverName,
+	}
+}
+
+func (s *sharedStore) Create(lobby *tradeLobby) error {
+	err := s.directory.Register(lobbyDocument{
+		Id:         lobby.wsLobby.Id,
+		Trainers:   lobby.expected,
+		State:      lobbyWaiting,
+		ServerName: s.serverName,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		return wrapLobbyStoreError(err)
+	}
+
+	return s.memoryStore.Create(lobby)
+}
+
+func (s *sharedStore) Start(lobbyId string) error {
+	if err := s.memoryStore.Start(lobbyId); err != nil {
+		return err
+	}
+
+	if err := s.directory.SetState(lobbyId, lobbyOngoing); err != nil {
+		return wrapLobbyStoreError(err)
+	}
+
+	return nil
+}
+
+func (s *sharedStore) Delete(lobbyId string) error {
+	_ = s.memoryStore.Delete(lobbyId)
+
+	if err := s.directory.Remove(lobbyId); err != nil {
+		return wrapLobbyStoreError(err)
+	}
+
+	return nil
+}
+
+func (s *sharedStore) Owner(lobbyId string) (string, bool, error) {
+	if _, _, ok := s.memoryStore.Get(lobbyId); ok {
+		return s.serverName, true, nil
+	}
+
+	document, ok, err := s.directory.Find(lobbyId)
+	if err != nil {
+		return "", false, wrapLobbyStoreError(err)
+	}
+
+	if !ok {
+		return "", false, nil
+	}
+
+	return document.ServerName, true, nil
+}
+
+type mongoDirectory struct {
+	collection *mongo.Collection
+}
+
+func newMongoLobbyStore(url string) (*sharedStore, error) {
+	collection, err := getMongoCollection(url, lobbiesCollectionName)
+	if err != nil {
+		return nil, wrapLobbyStoreError(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	// lobbies left by a previous run of this replica died with it
+	_, err = collection.DeleteMany(ctx, bson.M{"server_name": serverName})
+	if err != nil {
+		return nil, wrapLobbyStoreError(err)
+	}
+
+	return newSharedLobbyStore(&mongoDirectory{collection: collection}, serverName), nil
+}
+
+func (d *mongoDirectory) Register(document lobbyDocument) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := d.collection.InsertOne(ctx, document)
+	return err
+}
+
+func (d *mongoDirectory) SetState(lobbyId string, state lobbyState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := d.collection.UpdateOne(ctx, bson.M{"_id": lobbyId}, bson.M{"$set": bson.M{"state": state}})
+	return err
+}
+
+func (d *mongoDirectory) Remove(lobbyId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := d.collection.DeleteOne(ctx, bson.M{"_id": lobbyId})
+	return err
+}
+
+func (d *mongoDirectory) Find(lobbyId string) (*lobbyDocument, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	var document lobbyDocument
+	err := d.collection.FindOne(ctx, bson.M{"_id": lobbyId}).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	return &document, true, nil
+}
+
+// memoryDirectory is a directory shared by the stores of a single process, as in tests
+type memoryDirectory struct {
+	documents map[string]lobbyDocument
+	lock      sync.Mutex
+}
+
+func newMemoryLobbyDirectory() *memoryDirectory {
+	return &memoryDirectory{documents: map[string]lobbyDocument{}}
+}
+
+func (d *memoryDirectory) Register(document lobbyDocument) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.documents[document.Id] = document
+	return nil
+}
+
+func (d *memoryDirectory) SetState(lobbyId string, state lobbyState) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if document, ok := d.documents[lobbyId]; ok {
+		document.State = state
+		d.documents[lobbyId] = document
+	}
+	return nil
+}
+
+func (d *memoryDirectory) Remove(lobbyId string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.documents, lobbyId)
+	return nil
+}
+
+func (d *memoryDirectory) Find(lobbyId string) (*lobbyDocument, bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	document, ok := d.documents[lobbyId]
+	if !ok {
+		return nil, false, nil
+	}
+
+	return &document, true, nil
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSharedStoresKnowOwners(t *testing.T) {
+	directory := newMemoryLobbyDirectory()
+	owner := newSharedLobbyStore(directory, "trades-0")
+	other := newSharedLobbyStore(directory, "trades-1")
+
+	lobby := newTestTradeLobby("5ed0e3d8e1b2a3c4d5e6f7a8")
+	lobbyId := lobby.wsLobby.Id
+	if err := owner.Create(lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := other.Get(lobbyId); ok {
+		t.Error("trades-1 holds a lobby created in trades-0")
+	}
+
+	name, ok, err := other.Owner(lobbyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || name != "trades-0" {
+		t.Errorf("trades-1 sees the lobby owned by %q, expected trades-0", name)
+	}
+
+	originalLobbies, originalServerName := lobbies, serverName
+	lobbies, serverName = other, "trades-1"
+	config.ProxyJoins = true
+	defer func() {
+		lobbies, serverName = originalLobbies, originalServerName
+		config = defaultConfig()
+	}()
+
+	request := httptest.NewRequest("GET", "/trades/join/"+lobbyId, nil)
+	if name, proxy := shouldProxyJoin(request, lobbyId); !proxy || name != "trades-0" {
+		t.Errorf("join in trades-1 was proxied to %q (%t), expected trades-0", name, proxy)
+	}
+
+	request.Header.Set(forwardedByHeader, "trades-0")
+	if _, proxy := shouldProxyJoin(request, lobbyId); proxy {
+		t.Error("a join forwarded by another replica was proxied again")
+	}
+
+	if err = owner.Delete(lobbyId); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ = other.Owner(lobbyId); ok {
+		t.Error("trades-1 still sees the lobby after trades-0 deleted it")
+	}
+}
+
+func TestProxyJoinsNeedsSharedStore(t *testing.T) {
+	config = defaultConfig()
+	config.ProxyJoins = true
+	defer func() { config = defaultConfig() }()
+
+	original, set := os.LookupEnv(lobbyStoreEnvVar)
+	_ = os.Unsetenv(lobbyStoreEnvVar)
+	defer func() {
+		if set {
+			_ = os.Setenv(lobbyStoreEnvVar, original)
+		}
+	}()
+
+	if _, err := newLobbyStoreFromEnv(); err != errorProxyNeedsSharedStore {
+		t.Errorf("memory lobby store with proxied joins failed with %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+)
+
+// Trade message types handled by this service on top of the ones in the trades package
+const (
+	RemoveItem    = "REMOVE_ITEM"
+	Unaccept      = "UNACCEPT"
+	TradePokemon  = "TRADE_POKEMON"
+	RemovePokemon = "REMOVE_POKEMON"
+	OfferCoins    = "OFFER_COINS"
+	ConfirmTrade  = "CONFIRM_TRADE"
+
+	RequestItem    = "REQUEST_ITEM"
+	RequestPokemon = "REQUEST_POKEMON"
+	ApproveRequest = "APPROVE_REQUEST"
+	DeclineRequest = "DECLINE_REQUEST"
+	Inventories    = "INVENTORIES"
+
+	TimeoutWarning      = "TIMEOUT_WARNING"
+	TrainerDisconnected = "TRAINER_DISCONNECTED"
+	TrainerReconnected  = "TRAINER_RECONNECTED"
+)
+
+// TradeItemMessage is trades.TradeMessage with the trainer receiving the item, which trades
+// between two trainers may leave out
+type TradeItemMessage struct {
+	ItemId    string
+	Recipient string
+}
+
+type RemoveItemMessage struct {
+	ItemId string
+}
+
+type TradePokemonMessage struct {
+	PokemonId string
+	Recipient string
+}
+
+type RemovePokemonMessage struct {
+	PokemonId string
+}
+
+// OfferCoinsMessage sets the coins given to Recipient, which trades between two trainers may
+// leave out. An Amount of zero takes the coins offered back.
+type OfferCoinsMessage struct {
+	Amount    int
+	Recipient string
+}
+
+// RequestItemMessage asks From for one of their items, which trades between two trainers may
+// leave out
+type RequestItemMessage struct {
+	ItemId string
+	From   string
+}
+
+type RequestPokemonMessage struct {
+	PokemonId string
+	From      string
+}
+
+// AnswerRequestMessage approves or declines a request, depending on the type it is sent with
+type AnswerRequestMessage struct {
+	RequestId string
+}
+
+// InventoriesMessage tells trainers what each of them can offer, so they know what to request
+type InventoriesMessage struct {
+	Trainers []trainerAssets
+}
+
+func (iMsg InventoriesMessage) ConvertToWSMessage() *ws.WebsocketMsg {
+	return ws.NewStandardMsg(Inventories, iMsg)
+}
+
+// TimeoutWarningMessage tells trainers the trade will be aborted for Reason if nothing happens
+// in the next ExpiresIn seconds
+type TimeoutWarningMessage struct {
+	Reason    errorCode
+	ExpiresIn int
+}
+
+func (twMsg TimeoutWarningMessage) ConvertToWSMessage() *ws.WebsocketMsg {
+	return ws.NewStandardMsg(TimeoutWarning, twMsg)
+}
+
+// TrainerConnectionMessage tells a trainer the other one lost or recovered its connection. After
+// a disconnection, ExpiresIn is how many seconds the trainer has to reconnect.
+type TrainerConnectionMessage struct {
+	Username  string
+	ExpiresIn int
+}
+
+func (tcMsg TrainerConnectionMessage) ConvertToWSMessage(msgType string) *ws.WebsocketMsg {
+	return ws.NewStandardMsg(msgType, tcMsg)
+}
+
+// ErrorTradeMessage extends trades.ErrorTradeMessage with a code clients can react to
+type ErrorTradeMessage struct {
+	Code  errorCode
+	Info  string
+	Fatal bool
+}
+
+func (etMsg ErrorTradeMessage) ConvertToWSMessage(info ws.TrackedInfo) *ws.WebsocketMsg {
+	return ws.NewReplyMsg(ws.Error, etMsg, info)
+}
+
+// UpdateMessage is sent with the same type as trades.UpdateMessage, carrying the pokemons
+// offered as well
+type UpdateMessage struct {
+	TradeStatus tradeStatus
+}
+
+func updateMessageFromTrade(trade *tradeStatus) UpdateMessage {
+	return UpdateMessage{
+		TradeStatus: *trade,
+	}
+}
+
+func (uMsg UpdateMessage) ConvertToWSMessage(info ws.TrackedInfo) *ws.WebsocketMsg {
+	return ws.NewReplyMsg(trades.Update, uMsg, info)
+}
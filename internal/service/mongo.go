@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mongoURLEnvVar = "MONGODB_URL"
+	databaseName   = "NOVAPokemonDB"
+
+	mongoTimeout = 10 * time.Second
+)
+
+var (
+	mongoClient     *mongo.Client
+	mongoClientLock sync.Mutex
+)
+
+// getMongoCollection returns a collection of the service database, connecting to MongoDB the
+// first time it is called so every store shares the same client.
+func getMongoCollection(url, collectionName string) (*mongo.Collection, error) {
+	mongoClientLock.Lock()
+	defer mongoClientLock.Unlock()
+
+	if mongoClient == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+		defer cancel()
+
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(url))
+		if err != nil {
+			return nil, err
+		}
+
+		if err = client.Ping(ctx, nil); err != nil {
+			return nil, err
+		}
+
+		mongoClient = client
+	}
+
+	return mongoClient.Database(databaseName).Collection(collectionName), nil
+}
@@ -0,0 +1,275 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	ws "github.com/NOVAPokemon/utils/websockets"
+)
+
+type requestState string
+
+const (
+	requestPending  requestState = "PENDING"
+	requestApproved requestState = "APPROVED"
+	requestDeclined requestState = "DECLINED"
+)
+
+// tradeRequest is a trainer asking another for one of their items or pokemons. Once approved,
+// it is added to the offer of its owner, going to the requester.
+type tradeRequest struct {
+	Id        string
+	Requester string
+	Owner     string
+	ItemId    string
+	PokemonId string
+	State     requestState
+}
+
+// trainerAssets is what a trainer can offer in a trade, so the others know what to ask for
+type trainerAssets struct {
+	Username string
+	Items    []items.Item
+	Pokemons []pokemons.Pokemon
+	Coins    int
+}
+
+func (lobby *tradeLobby) handleRequestItemMessage(trackInfo *ws.TrackedInfo, requestMsg *RequestItemMessage,
+	trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	itemId := requestMsg.ItemId
+
+	owner, ok := lobby.counterparty(trainerNum, requestMsg.From)
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeInvalidRecipient,
+			Info:  fmt.Sprintf("%s can not be asked for %s", requestMsg.From, itemId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+	ownerNum, _ := lobby.trainerNum(owner)
+
+	lobby.itemsLock.Lock()
+	item, owned := lobby.availableItems[ownerNum][itemId]
+	lobby.itemsLock.Unlock()
+
+	if !owned {
+		return ErrorTradeMessage{
+			Code:  codeItemNotOwned,
+			Info:  fmt.Sprintf("%s does not have %s", owner, itemId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if err := config.Rules.checkItem(lobby.traders[ownerNum], item, lobby.clock()); err != nil {
+		return ErrorTradeMessage{
+			Code:  codeTradeRuleViolated,
+			Info:  err.Error(),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	for _, itemAdded := range trade.Players[ownerNum].Items {
+		if itemAdded.Id == itemId {
+			return ErrorTradeMessage{
+				Code:  codeItemAlreadyOffered,
+				Info:  fmt.Sprintf("%s already added %s", owner, itemId),
+				Fatal: false,
+			}.ConvertToWSMessage(*trackInfo)
+		}
+	}
+
+	return lobby.addRequest(trackInfo, trade, tradeRequest{
+		Requester: lobby.trainers[trainerNum],
+		Owner:     owner,
+		ItemId:    itemId,
+	})
+}
+
+func (lobby *tradeLobby) handleRequestPokemonMessage(trackInfo *ws.TrackedInfo,
+	requestMsg *RequestPokemonMessage, trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	pokemonId := requestMsg.PokemonId
+
+	owner, ok := lobby.counterparty(trainerNum, requestMsg.From)
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeInvalidRecipient,
+			Info:  fmt.Sprintf("%s can not be asked for pokemon %s", requestMsg.From, pokemonId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+	ownerNum, _ := lobby.trainerNum(owner)
+
+	lobby.itemsLock.Lock()
+	pokemon, owned := lobby.availablePokemons[ownerNum][pokemonId]
+	lobby.itemsLock.Unlock()
+
+	if !owned {
+		return ErrorTradeMessage{
+			Code:  codePokemonNotOwned,
+			Info:  fmt.Sprintf("%s does not have pokemon %s", owner, pokemonId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if err := config.Rules.checkPokemon(lobby.traders[ownerNum], pokemon, lobby.clock()); err != nil {
+		return ErrorTradeMessage{
+			Code:  codeTradeRuleViolated,
+			Info:  err.Error(),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	for _, pokemonAdded := range trade.Players[ownerNum].Pokemons {
+		if pokemonAdded.Id == pokemonId {
+			return ErrorTradeMessage{
+				Code:  codePokemonAlreadyOffered,
+				Info:  fmt.Sprintf("%s already added pokemon %s", owner, pokemonId),
+				Fatal: false,
+			}.ConvertToWSMessage(*trackInfo)
+		}
+	}
+
+	return lobby.addRequest(trackInfo, trade, tradeRequest{
+		Requester: lobby.trainers[trainerNum],
+		Owner:     owner,
+		PokemonId: pokemonId,
+	})
+}
+
+// addRequest makes the request pending unless the same one already is. A trainer can not have
+// more requests pending than fit in an offer.
+func (lobby *tradeLobby) addRequest(trackInfo *ws.TrackedInfo, trade *tradeStatus,
+	request tradeRequest) *ws.WebsocketMsg {
+	pending := 0
+	for _, made := range trade.Requests {
+		if made.State != requestPending {
+			continue
+		}
+
+		if made.Owner == request.Owner && made.ItemId == request.ItemId && made.PokemonId == request.PokemonId {
+			return ErrorTradeMessage{
+				Code:  codeRequestAlreadyMade,
+				Info:  fmt.Sprintf("request %s already asks for it", made.Id),
+				Fatal: false,
+			}.ConvertToWSMessage(*trackInfo)
+		}
+
+		if made.Requester == request.Requester {
+			pending++
+		}
+	}
+
+	if pending >= config.MaxItemsPerOffer {
+		return ErrorTradeMessage{
+			Code:  codeOfferTooLarge,
+			Info:  fmt.Sprintf("can not have more than %d requests pending", config.MaxItemsPerOffer),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	request.Id = strconv.Itoa(len(trade.Requests) + 1)
+	request.State = requestPending
+	trade.Requests = append(trade.Requests, request)
+	resetAcceptance(trade)
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}
+
+// handleAnswerRequestMessage lets the owner of what was requested approve or decline it. Approving
+// adds it to the offer of the owner as if they had offered it themselves.
+func (lobby *tradeLobby) handleAnswerRequestMessage(trackInfo *ws.TrackedInfo, answerMsg *AnswerRequestMessage,
+	trade *tradeStatus, trainerNum int, approve bool) *ws.WebsocketMsg {
+	requestNum := -1
+	for i, request := range trade.Requests {
+		if request.Id == answerMsg.RequestId && request.Owner == lobby.trainers[trainerNum] {
+			requestNum = i
+			break
+		}
+	}
+
+	if requestNum == -1 {
+		return ErrorTradeMessage{
+			Code:  codeRequestNotFound,
+			Info:  fmt.Sprintf("no request %s made to you", answerMsg.RequestId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	request := &trade.Requests[requestNum]
+	if request.State != requestPending {
+		return ErrorTradeMessage{
+			Code:  codeRequestNotPending,
+			Info:  fmt.Sprintf("request %s was already %s", request.Id, request.State),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if !approve {
+		request.State = requestDeclined
+		return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+	}
+
+	// approved before offering so the update sent carries it, and undone if the offer fails
+	request.State = requestApproved
+
+	var answer *ws.WebsocketMsg
+	if request.ItemId != "" {
+		answer = lobby.offerItem(trackInfo, trade, trainerNum, request.ItemId, request.Requester)
+	} else {
+		answer = lobby.offerPokemon(trackInfo, trade, trainerNum, request.PokemonId, request.Requester)
+	}
+
+	if answer.Content.AppMsgType == ws.Error {
+		request.State = requestPending
+	}
+
+	return answer
+}
+
+// reopenRequests makes the approved requests for what the owner took out of their offer pending
+// again, so they can be approved once more or declined
+func reopenRequests(trade *tradeStatus, owner, itemId, pokemonId string) {
+	for i := range trade.Requests {
+		request := &trade.Requests[i]
+		if request.State == requestApproved && request.Owner == owner && request.ItemId == itemId &&
+			request.PokemonId == pokemonId {
+			request.State = requestPending
+		}
+	}
+}
+
+// inventoriesMessage has what every trainer in the trade can offer
+func (lobby *tradeLobby) inventoriesMessage() InventoriesMessage {
+	lobby.itemsLock.Lock()
+	defer lobby.itemsLock.Unlock()
+
+	inventories := make([]trainerAssets, len(lobby.trainers))
+	for trainerNum, username := range lobby.trainers {
+		assets := trainerAssets{
+			Username: username,
+			Items:    make([]items.Item, 0, len(lobby.availableItems[trainerNum])),
+			Pokemons: make([]pokemons.Pokemon, 0, len(lobby.availablePokemons[trainerNum])),
+			Coins:    lobby.initialStats[trainerNum].Coins,
+		}
+
+		for _, item := range lobby.availableItems[trainerNum] {
+			assets.Items = append(assets.Items, item)
+		}
+		sort.Slice(assets.Items, func(i, j int) bool {
+			return assets.Items[i].Id < assets.Items[j].Id
+		})
+
+		for _, pokemon := range lobby.availablePokemons[trainerNum] {
+			assets.Pokemons = append(assets.Pokemons, pokemon)
+		}
+		sort.Slice(assets.Pokemons, func(i, j int) bool {
+			return assets.Pokemons[i].Id < assets.Pokemons[j].Id
+		})
+
+		inventories[trainerNum] = assets
+	}
+
+	return InventoriesMessage{Trainers: inventories}
+}
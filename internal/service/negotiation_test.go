@@ -0,0 +1,113 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+)
+
+// newTestTradeLobby starts a trade between ash and misty, each owning an item and a pokemon
+func newTestTradeLobby(lobbyId string) *tradeLobby {
+	config = defaultConfig()
+
+	info := ws.NewTrackedInfo(lobbyId)
+	lobby := newTradeLobby(lobbyId, []string{"ash", "misty"}, &info)
+	copy(lobby.trainers, lobby.expected)
+	lobby.availableItems = []trades.ItemsMap{
+		{"ash-potion": items.Item{Id: "ash-potion", Name: "potion"}},
+		{"misty-pokeball": items.Item{Id: "misty-pokeball", Name: "pokeball"}},
+	}
+	lobby.availablePokemons = []pokemonsMap{
+		{"ash-pikachu": pokemons.Pokemon{Id: "ash-pikachu", Species: "pikachu", Level: 5}},
+		{"misty-staryu": pokemons.Pokemon{Id: "misty-staryu", Species: "staryu", Level: 7}},
+	}
+	lobby.initialStats = []utils.TrainerStats{{Level: 3, Coins: 50}, {Level: 4, Coins: 20}}
+	lobby.traders = []traderRecord{{Level: 3}, {Level: 4}}
+	lobby.withStats = []bool{true, true}
+	lobby.initStatus()
+	return lobby
+}
+
+func TestRemovingApprovedRequestReopensIt(t *testing.T) {
+	tests := []struct {
+		name    string
+		request interface{}
+		remove  interface{}
+		offered func(player tradePlayer) int
+	}{
+		{
+			name:    "item",
+			request: &RequestItemMessage{ItemId: "misty-pokeball"},
+			remove:  &RemoveItemMessage{ItemId: "misty-pokeball"},
+			offered: func(player tradePlayer) int { return len(player.Items) },
+		},
+		{
+			name:    "pokemon",
+			request: &RequestPokemonMessage{PokemonId: "misty-staryu"},
+			remove:  &RemovePokemonMessage{PokemonId: "misty-staryu"},
+			offered: func(player tradePlayer) int { return len(player.Pokemons) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lobby := newTestTradeLobby("reopen-" + test.name)
+			defer escrow.ReleaseLobby(lobby.wsLobby.Id)
+			trade := lobby.status
+			info := ws.NewTrackedInfo(test.name)
+
+			var answer *ws.WebsocketMsg
+			switch request := test.request.(type) {
+			case *RequestItemMessage:
+				answer = lobby.handleRequestItemMessage(&info, request, trade, 0)
+			case *RequestPokemonMessage:
+				answer = lobby.handleRequestPokemonMessage(&info, request, trade, 0)
+			}
+			expectUpdate(t, answer)
+
+			answer = lobby.handleAnswerRequestMessage(&info, &AnswerRequestMessage{RequestId: trade.Requests[0].Id},
+				trade, 1, true)
+			expectUpdate(t, answer)
+			if trade.Requests[0].State != requestApproved || test.offered(trade.Players[1]) != 1 {
+				t.Fatalf("request %s with %d offered after approving", trade.Requests[0].State,
+					test.offered(trade.Players[1]))
+			}
+
+			switch remove := test.remove.(type) {
+			case *RemoveItemMessage:
+				answer = lobby.handleRemoveItemMessage(&info, remove, trade, 1)
+			case *RemovePokemonMessage:
+				answer = lobby.handleRemovePokemonMessage(&info, remove, trade, 1)
+			}
+			expectUpdate(t, answer)
+
+			if trade.Requests[0].State != requestPending {
+				t.Errorf("request %s after removing what it asked for, expected %s", trade.Requests[0].State,
+					requestPending)
+			}
+			if test.offered(trade.Players[1]) != 0 {
+				t.Error("removed offer is still in the trade")
+			}
+
+			answer = lobby.handleAnswerRequestMessage(&info, &AnswerRequestMessage{RequestId: trade.Requests[0].Id},
+				trade, 1, true)
+			expectUpdate(t, answer)
+			if trade.Requests[0].State != requestApproved || test.offered(trade.Players[1]) != 1 {
+				t.Error("reopened request could not be approved again")
+			}
+		})
+	}
+}
+
+func expectUpdate(t *testing.T, answer *ws.WebsocketMsg) {
+	t.Helper()
+
+	if answer.Content.AppMsgType != trades.Update {
+		t.Fatalf("answered with %s %+v, expected %s", answer.Content.AppMsgType, answer.Content.Data,
+			trades.Update)
+	}
+}
@@ -0,0 +1,445 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type offerState string
+
+const (
+	offerPending   offerState = "PENDING"
+	offerAccepted  offerState = "ACCEPTED"
+	offerDeclined  offerState = "DECLINED"
+	offerCountered offerState = "COUNTERED"
+	offerExpired   offerState = "EXPIRED"
+	offerFailed    offerState = "FAILED"
+)
+
+const (
+	offerStoreEnvVar = "TRADES_OFFER_STORE"
+
+	memoryOfferStore = "memory"
+	mongoOfferStore  = "mongo"
+
+	offersCollectionName = "TradeOffers"
+
+	tradeOfferNotification = "TRADE_OFFER"
+)
+
+// tradeOffer is an exchange proposed by Sender that Recipient answers later, without either of
+// them connected. The requested items and pokemons are only known by id until the recipient
+// accepts. The sender is not there when the offer is accepted, so their part of the commit is made
+// with the auth token they made the offer with, kept in offerGrants.
+type tradeOffer struct {
+	Id                string             `json:"id" bson:"_id"`
+	Sender            string             `json:"sender" bson:"sender"`
+	Recipient         string             `json:"recipient" bson:"recipient"`
+	Items             []items.Item       `json:"items" bson:"items"`
+	Pokemons          []pokemons.Pokemon `json:"pokemons" bson:"pokemons"`
+	RequestedItems    []string           `json:"requested_items" bson:"requested_items"`
+	RequestedPokemons []string           `json:"requested_pokemons" bson:"requested_pokemons"`
+	State             offerState         `json:"state" bson:"state"`
+	CounterOf         string             `json:"counter_of,omitempty" bson:"counter_of,omitempty"`
+	CreatedAt         time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt         time.Time          `json:"expires_at" bson:"expires_at"`
+}
+
+// tradeOfferRequest proposes giving Items and Pokemons to Recipient in exchange for the requested
+// ones, all of them by id
+type tradeOfferRequest struct {
+	Recipient         string
+	Items             []string
+	Pokemons          []string
+	RequestedItems    []string
+	RequestedPokemons []string
+}
+
+func (request *tradeOfferRequest) validate(sender string) error {
+	if request.Recipient == "" || request.Recipient == sender {
+		return newInvalidOfferError("invalid recipient")
+	}
+
+	offered := len(request.Items) + len(request.Pokemons)
+	requested := len(request.RequestedItems) + len(request.RequestedPokemons)
+	if offered+requested == 0 {
+		return newInvalidOfferError("nothing to exchange")
+	}
+
+	if offered > config.MaxItemsPerOffer || requested > config.MaxItemsPerOffer {
+		return newInvalidOfferError(fmt.Sprintf("offers can not have more than %d items",
+			config.MaxItemsPerOffer))
+	}
+
+	for _, ids := range [][]string{request.Items, request.Pokemons, request.RequestedItems,
+		request.RequestedPokemons} {
+		seen := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			if seen[id] {
+				return newInvalidOfferError(fmt.Sprintf("%s included more than once", id))
+			}
+			seen[id] = true
+		}
+	}
+
+	return nil
+}
+
+// tradeOfferResponse carries the tokens of the trainer that accepted an offer, since their items
+// and pokemons changed
+type tradeOfferResponse struct {
+	Offer  *tradeOffer `json:"offer"`
+	Tokens []string    `json:"tokens,omitempty"`
+}
+
+type tradeOfferNotificationContent struct {
+	OfferId  string
+	Username string
+	State    offerState
+}
+
+// offerStore keeps trade offers. Transition only changes the state of an offer that is still in
+// the from state, so two answers to the same offer can not both succeed.
+type offerStore interface {
+	Create(offer *tradeOffer) error
+	Get(offerId string) (*tradeOffer, bool, error)
+	Transition(offerId string, from, to offerState) (bool, error)
+	ListByTrainer(username string) ([]*tradeOffer, error)
+}
+
+// offerGrants keeps the auth token each pending offer was made with. Tokens are only held in
+// memory, never in the offer store, so an offer can only be accepted on the replica it was made to
+// and before that replica restarts. Otherwise the sender has to make it again.
+type offerGrants struct {
+	tokens map[string]string
+	lock   sync.Mutex
+}
+
+var grants = &offerGrants{tokens: map[string]string{}}
+
+func (g *offerGrants) grant(offerId, authToken string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.tokens[offerId] = authToken
+}
+
+func (g *offerGrants) get(offerId string) (string, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	authToken, ok := g.tokens[offerId]
+	return authToken, ok
+}
+
+// revoke forgets the token once the offer can no longer be accepted
+func (g *offerGrants) revoke(offerId string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	delete(g.tokens, offerId)
+}
+
+func newOfferStoreFromEnv() (offerStore, error) {
+	storeType, exists := os.LookupEnv(offerStoreEnvVar)
+	if !exists {
+		storeType = memoryOfferStore
+	}
+
+	switch storeType {
+	case memoryOfferStore:
+		return &memoryOffers{offers: map[string]*tradeOffer{}}, nil
+	case mongoOfferStore:
+		url, exists := os.LookupEnv(mongoURLEnvVar)
+		if !exists {
+			return nil, errorNoMongoURL
+		}
+		return newMongoOffers(url)
+	default:
+		return nil, newInvalidOfferStoreError(storeType)
+	}
+}
+
+func (offer *tradeOffer) isExpired() bool {
+	return offer.State == offerPending && time.Now().After(offer.ExpiresAt)
+}
+
+// expire moves an offer past its deadline to the expired state, as offers are not expired
+// until someone looks at them
+func (offer *tradeOffer) expire() error {
+	if !offer.isExpired() {
+		return nil
+	}
+
+	if _, err := offers.Transition(offer.Id, offerPending, offerExpired); err != nil {
+		return err
+	}
+
+	grants.revoke(offer.Id)
+	offer.State = offerExpired
+	return nil
+}
+
+func (offer *tradeOffer) journalEntry(requestedItems []items.Item, requestedPokemons []pokemons.Pokemon,
+	senderToken, recipientToken string) *journalEntry {
+	return &journalEntry{
+		LobbyId:    offer.Id,
+		Trainers:   []string{offer.Sender, offer.Recipient},
+		Items:      [][]items.Item{offer.Items, requestedItems},
+		Pokemons:   [][]pokemons.Pokemon{offer.Pokemons, requestedPokemons},
+		AuthTokens: []string{senderToken, recipientToken},
+		State:      journalPreparing,
+	}
+}
+
+// recordOfferOutcome adds an answered offer to the trade history, with whatever is known of the
+// requested items and pokemons
+func recordOfferOutcome(offer *tradeOffer, outcome tradeOutcome, requestedItems []items.Item,
+	requestedPokemons []pokemons.Pokemon) {
+	record := &tradeRecord{
+		LobbyId:    offer.Id,
+		Trainers:   []string{offer.Sender, offer.Recipient},
+		Outcome:    outcome,
+		Items:      [][]items.Item{offer.Items, requestedItems},
+		Pokemons:   [][]pokemons.Pokemon{offer.Pokemons, requestedPokemons},
+		CreatedAt:  offer.CreatedAt,
+		FinishedAt: time.Now(),
+	}
+
+	if err := history.Add(record); err != nil {
+		log.Error(wrapTradeHistoryError(err))
+	}
+
+	recordAuditEvent(offer.Id, auditTradeFinished, "", map[string]interface{}{"outcome": outcome}, nil)
+}
+
+// ownsOffered checks with the trainers service that the trainer still has every item and pokemon
+func ownsOffered(trainersClient trainersService, username string, toCheck []items.Item,
+	pokemonsToCheck []pokemons.Pokemon) (bool, error) {
+	trainer, err := trainersClient.GetTrainerByUsername(username)
+	if err != nil {
+		return false, err
+	}
+
+	for _, item := range toCheck {
+		if _, ok := trainer.Items[item.Id]; !ok {
+			return false, nil
+		}
+	}
+
+	for _, pokemon := range pokemonsToCheck {
+		if _, ok := trainer.Pokemons[pokemon.Id]; !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// loadOfferTrader gathers what the rules need to know about a trainer in an offer. Offers come
+// without a stats token, so the level is asked to the trainers service when a rule needs it.
+func loadOfferTrader(trainersClient trainersService, username string) (traderRecord, error) {
+	var stats utils.TrainerStats
+	if config.Rules.MinTrainerLevel > 0 {
+		trainer, err := trainersClient.GetTrainerByUsername(username)
+		if err != nil {
+			return traderRecord{}, err
+		}
+		stats = trainer.Stats
+	}
+
+	return config.Rules.loadTraderRecord(username, stats, time.Now())
+}
+
+// loadRequested finds what the recipient of an offer is asked for, as far as they own it, so the
+// rules can be applied to it. Whatever they do not own fails the offer when it is accepted.
+func loadRequested(trainersClient trainersService, recipient string, itemIds,
+	pokemonIds []string) (traderRecord, []items.Item, []pokemons.Pokemon, error) {
+	trainer, err := trainersClient.GetTrainerByUsername(recipient)
+	if err != nil {
+		return traderRecord{}, nil, nil, err
+	}
+
+	record, err := config.Rules.loadTraderRecord(recipient, trainer.Stats, time.Now())
+	if err != nil {
+		return traderRecord{}, nil, nil, err
+	}
+
+	var requestedItems []items.Item
+	for _, itemId := range itemIds {
+		if item, ok := trainer.Items[itemId]; ok {
+			requestedItems = append(requestedItems, item)
+		}
+	}
+
+	var requestedPokemons []pokemons.Pokemon
+	for _, pokemonId := range pokemonIds {
+		if pokemon, ok := trainer.Pokemons[pokemonId]; ok {
+			requestedPokemons = append(requestedPokemons, pokemon)
+		}
+	}
+
+	return record, requestedItems, requestedPokemons, nil
+}
+
+// checkOffered applies the rules to what a trainer gives away in an offer
+func checkOffered(record traderRecord, toCheck []items.Item, pokemonsToCheck []pokemons.Pokemon,
+	now time.Time) error {
+	for _, item := range toCheck {
+		if err := config.Rules.checkItem(record, item, now); err != nil {
+			return err
+		}
+	}
+
+	for _, pokemon := range pokemonsToCheck {
+		if err := config.Rules.checkPokemon(record, pokemon, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// memoryOffers is the default store. Offers are lost on restart and are not visible to other
+// replicas, so deployments with more than one replica have to pick the mongo store.
+type memoryOffers struct {
+	offers map[string]*tradeOffer
+	lock   sync.RWMutex
+}
+
+func (s *memoryOffers) Create(offer *tradeOffer) error {
+	s.lock.Lock()
+	stored := *offer
+	s.offers[offer.Id] = &stored
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryOffers) Get(offerId string) (*tradeOffer, bool, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	stored, ok := s.offers[offerId]
+	if !ok {
+		return nil, false, nil
+	}
+
+	offer := *stored
+	return &offer, true, nil
+}
+
+func (s *memoryOffers) Transition(offerId string, from, to offerState) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stored, ok := s.offers[offerId]
+	if !ok || stored.State != from {
+		return false, nil
+	}
+
+	stored.State = to
+	return true, nil
+}
+
+func (s *memoryOffers) ListByTrainer(username string) ([]*tradeOffer, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var trainerOffers []*tradeOffer
+	for _, stored := range s.offers {
+		if stored.Sender != username && stored.Recipient != username {
+			continue
+		}
+
+		offer := *stored
+		trainerOffers = append(trainerOffers, &offer)
+	}
+
+	sort.Slice(trainerOffers, func(i, j int) bool {
+		return trainerOffers[i].CreatedAt.After(trainerOffers[j].CreatedAt)
+	})
+
+	return trainerOffers, nil
+}
+
+type mongoOffers struct {
+	collection *mongo.Collection
+}
+
+func newMongoOffers(url string) (*mongoOffers, error) {
+	collection, err := getMongoCollection(url, offersCollectionName)
+	if err != nil {
+		return nil, wrapOfferStoreError(err)
+	}
+
+	return &mongoOffers{collection: collection}, nil
+}
+
+func (s *mongoOffers) Create(offer *tradeOffer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	if _, err := s.collection.InsertOne(ctx, offer); err != nil {
+		return wrapOfferStoreError(err)
+	}
+
+	return nil
+}
+
+func (s *mongoOffers) Get(offerId string) (*tradeOffer, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	offer := &tradeOffer{}
+	err := s.collection.FindOne(ctx, bson.M{"_id": offerId}).Decode(offer)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, wrapOfferStoreError(err)
+	}
+
+	return offer, true, nil
+}
+
+func (s *mongoOffers) Transition(offerId string, from, to offerState) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": offerId, "state": from},
+		bson.M{"$set": bson.M{"state": to}})
+	if err != nil {
+		return false, wrapOfferStoreError(err)
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (s *mongoOffers) ListByTrainer(username string) ([]*tradeOffer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	filter := bson.M{"$or": []bson.M{{"sender": username}, {"recipient": username}}}
+	cursor, err := s.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": -1}))
+	if err != nil {
+		return nil, wrapOfferStoreError(err)
+	}
+
+	var trainerOffers []*tradeOffer
+	if err = cursor.All(ctx, &trainerOffers); err != nil {
+		return nil, wrapOfferStoreError(err)
+	}
+
+	return trainerOffers, nil
+}
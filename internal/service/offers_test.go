@@ -0,0 +1,124 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NOVAPokemon/utils/pokemons"
+)
+
+func TestOfferRules(t *testing.T) {
+	fakes, cleanup := setupCommitTest(t)
+	defer cleanup()
+
+	accounts = &memoryAccounts{firstSeen: map[string]time.Time{}}
+	config = defaultConfig()
+	config.Rules.UntradeableItems = []string{"pokeball"}
+	config.Rules.UntradeableSpecies = []string{"pikachu"}
+	defer func() { config = defaultConfig() }()
+
+	record, requestedItems, requestedPokemons, err := loadRequested(fakes, "misty",
+		[]string{"misty-pokeball", "not-owned"}, []string{"misty-staryu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requestedItems) != 1 || len(requestedPokemons) != 1 {
+		t.Fatalf("loaded %v and %v, expected only what misty owns", requestedItems, requestedPokemons)
+	}
+
+	if err = checkOffered(record, requestedItems, nil, time.Now()); err == nil {
+		t.Error("untradeable pokeball was requested")
+	}
+
+	if err = checkOffered(record, nil, requestedPokemons, time.Now()); err != nil {
+		t.Errorf("requesting staryu was not allowed: %s", err)
+	}
+
+	ash, err := loadOfferTrader(fakes, "ash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned := inventories(t, fakes)["ash"]
+	if err = checkOffered(ash, nil, []pokemons.Pokemon{owned.Pokemons["ash-pikachu"]}, time.Now()); err == nil {
+		t.Error("untradeable pikachu was offered")
+	}
+}
+
+// makeTradeOffer has ash offer a potion to misty for a pokeball
+func makeTradeOffer(t *testing.T, server *httptest.Server) *tradeOffer {
+	t.Helper()
+
+	request := tradeOfferRequest{
+		Recipient:      "misty",
+		Items:          []string{"ash-potion"},
+		RequestedItems: []string{"misty-pokeball"},
+	}
+
+	var response tradeOfferResponse
+	if status := postJSON(t, server, tradeOffersPath, "ash", request, &response); status != http.StatusOK {
+		t.Fatalf("making an offer answered %d", status)
+	}
+
+	return response.Offer
+}
+
+func acceptOfferPath(offerId string) string {
+	return strings.Replace(acceptTradeOfferPath, "{"+offerIdVar+"}", offerId, 1)
+}
+
+func TestAcceptTradeOffer(t *testing.T) {
+	fakes, server, cleanup := setupTradeServer(t)
+	defer cleanup()
+
+	offer := makeTradeOffer(t, server)
+
+	var response tradeOfferResponse
+	if status := postJSON(t, server, acceptOfferPath(offer.Id), "misty", nil, &response); status != http.StatusOK {
+		t.Fatalf("accepting the offer answered %d", status)
+	}
+
+	if response.Offer.State != offerAccepted {
+		t.Errorf("offer is %s, expected %s", response.Offer.State, offerAccepted)
+	}
+
+	owned := inventories(t, fakes)
+	if _, ok := owned["ash"].Items["misty-pokeball"]; !ok {
+		t.Errorf("ash owns items %v, expected misty-pokeball among them", owned["ash"].Items)
+	}
+	if _, ok := owned["misty"].Items["ash-potion"]; !ok {
+		t.Errorf("misty owns items %v, expected ash-potion among them", owned["misty"].Items)
+	}
+
+	if _, granted := grants.get(offer.Id); granted {
+		t.Error("the sender token was kept after the offer was accepted")
+	}
+}
+
+func TestAcceptTradeOfferWithoutGrant(t *testing.T) {
+	fakes, server, cleanup := setupTradeServer(t)
+	defer cleanup()
+
+	original := inventories(t, fakes)
+	offer := makeTradeOffer(t, server)
+	grants.revoke(offer.Id)
+
+	var response httpErrorBody
+	status := postJSON(t, server, acceptOfferPath(offer.Id), "misty", nil, &response)
+	if status != http.StatusConflict {
+		t.Errorf("accepting the offer answered %d, expected %d", status, http.StatusConflict)
+	}
+
+	if response.Code != codeOfferNotGranted {
+		t.Errorf("accepting the offer failed with %s, expected %s", response.Code, codeOfferNotGranted)
+	}
+
+	if owned := inventories(t, fakes); !reflect.DeepEqual(owned, original) {
+		t.Error("trainers changed items without the sender authorizing it")
+	}
+}
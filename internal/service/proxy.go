@@ -0,0 +1,98 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// forwardedByHeader marks join requests proxied by another replica so they are never proxied again
+const forwardedByHeader = "X-Trades-Forwarded-By"
+
+// headers set by the dialer itself, which refuses them if they are also passed in
+var handshakeHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+}
+
+// shouldProxyJoin tells whether a join for a lobby this replica does not have should be proxied,
+// returning the name of the replica that owns the lobby. Joins are only proxied when enabled in the
+// configuration, which requires a lobby store shared by all replicas.
+func shouldProxyJoin(r *http.Request, lobbyId string) (string, bool) {
+	if !config.ProxyJoins || r.Header.Get(forwardedByHeader) != "" {
+		return "", false
+	}
+
+	owner, ok, err := lobbies.Owner(lobbyId)
+	if err != nil {
+		log.Warn(wrapProxyJoinError(err))
+		return "", false
+	}
+
+	return owner, ok && owner != serverName
+}
+
+// proxyJoinToOwner opens a connection to the replica owning the lobby with the same request and
+// relays frames between it and the client until either side closes.
+func proxyJoinToOwner(clientConn *websocket.Conn, r *http.Request, owner string) error {
+	ownerURL := url.URL{
+		Scheme:   "ws",
+		Host:     fmt.Sprintf("%s.%s:%d", owner, serviceNameHeadless, port),
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+
+	header := http.Header{}
+	for name, values := range r.Header {
+		if handshakeHeaders[name] {
+			continue
+		}
+		header[name] = values
+	}
+	header.Set(forwardedByHeader, serverName)
+
+	ownerConn, _, err := websocket.DefaultDialer.Dial(ownerURL.String(), header)
+	if err != nil {
+		return wrapProxyJoinError(err)
+	}
+
+	log.Infof("proxying join of lobby in %s", ownerURL.String())
+
+	done := make(chan struct{}, 2)
+	go relayFrames(clientConn, ownerConn, done)
+	go relayFrames(ownerConn, clientConn, done)
+	<-done
+
+	if err = ownerConn.Close(); err != nil {
+		log.Warn(wrapProxyJoinError(err))
+	}
+
+	if err = clientConn.Close(); err != nil {
+		log.Warn(wrapProxyJoinError(err))
+	}
+
+	return nil
+}
+
+func relayFrames(from, to *websocket.Conn, done chan<- struct{}) {
+	defer func() {
+		done <- struct{}{}
+	}()
+
+	for {
+		msgType, data, err := from.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if err = to.WriteMessage(msgType, data); err != nil {
+			return
+		}
+	}
+}
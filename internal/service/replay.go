@@ -0,0 +1,301 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+)
+
+const replayEscrowHolder = "replay"
+
+// lobbySnapshot is what a trade starts from, recorded in the audit log so it can be replayed
+type lobbySnapshot struct {
+	Trainers []string
+	Items    []trades.ItemsMap
+	Pokemons []pokemonsMap
+	Stats    []utils.TrainerStats
+	Traders  []traderRecord
+
+	// WithStats is missing from trades recorded when every trainer joined with a stats token
+	WithStats []bool `json:",omitempty"`
+}
+
+// replayStep is a recorded trade message handled again, with what it was answered both times
+type replayStep struct {
+	Action   string        `json:"action"`
+	Trainer  string        `json:"trainer"`
+	Recorded messageAnswer `json:"recorded"`
+	Replayed messageAnswer `json:"replayed"`
+	Matches  bool          `json:"matches"`
+}
+
+// replayReport tells whether a replay reproduced the recorded trade. The final status can only be
+// compared when the audit log has how the trade finished.
+type replayReport struct {
+	LobbyId        string       `json:"lobby_id"`
+	Steps          []replayStep `json:"steps"`
+	FinalStatus    *tradeStatus `json:"final_status"`
+	StatusRecorded bool         `json:"status_recorded"`
+	StatusMatches  bool         `json:"status_matches"`
+	Diverged       bool         `json:"diverged"`
+}
+
+func (lobby *tradeLobby) snapshot() lobbySnapshot {
+	lobby.itemsLock.Lock()
+	defer lobby.itemsLock.Unlock()
+
+	return lobbySnapshot{
+		Trainers:  lobby.trainers,
+		Items:     lobby.availableItems,
+		Pokemons:  lobby.availablePokemons,
+		Stats:     lobby.initialStats,
+		Traders:   lobby.traders,
+		WithStats: lobby.withStats,
+	}
+}
+
+// Replay drives the trade messages in an exported audit log through the same handlers, in order
+// and offline, and writes the report to out. It fails if the replay diverged, so a recorded trade
+// can be kept as a regression check. The configuration is loaded as the service does, so flags
+// must be parsed first.
+func Replay(auditFile string, out io.Writer) error {
+	loadedConfig, err := loadConfig()
+	if err != nil {
+		return wrapReplayError(err)
+	}
+	config = loadedConfig
+
+	return replayTrade(auditFile, out)
+}
+
+func replayTrade(auditFile string, out io.Writer) error {
+	eventsBytes, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		return wrapReplayError(err)
+	}
+
+	var events []*auditEvent
+	if err = json.Unmarshal(eventsBytes, &events); err != nil {
+		return wrapReplayError(err)
+	}
+
+	report, err := replayEvents(events)
+	if err != nil {
+		return wrapReplayError(err)
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		return wrapReplayError(err)
+	}
+
+	if report.Diverged {
+		return wrapReplayError(errorReplayDiverged)
+	}
+
+	return nil
+}
+
+// replayEvents releases whatever the replayed lobby left in escrow, as it never ends like a live one
+func replayEvents(events []*auditEvent) (*replayReport, error) {
+	var lobby *tradeLobby
+	defer func() {
+		if lobby != nil {
+			escrow.ReleaseLobby(lobby.wsLobby.Id)
+		}
+	}()
+
+	report := &replayReport{Steps: []replayStep{}}
+	for _, event := range events {
+		_, isMessage := event.Data["answer"]
+
+		switch {
+		case event.Action == auditTradeStarted:
+			snapshot := lobbySnapshot{}
+			if err := remarshal(event.Data["snapshot"], &snapshot); err != nil {
+				return nil, err
+			}
+
+			replayed, err := newReplayLobby(event.LobbyId, snapshot)
+			if err != nil {
+				return nil, err
+			}
+
+			if lobby != nil {
+				escrow.ReleaseLobby(lobby.wsLobby.Id)
+			}
+			lobby = replayed
+			report.LobbyId = event.LobbyId
+		case lobby == nil:
+			continue
+		case isMessage:
+			step, err := lobby.replayMessage(event)
+			if err != nil {
+				return nil, err
+			}
+
+			report.Steps = append(report.Steps, step)
+			report.Diverged = report.Diverged || !step.Matches
+		case event.Action == auditTradeFinished && event.Data["status"] != nil:
+			recorded := &tradeStatus{}
+			if err := remarshal(event.Data["status"], recorded); err != nil {
+				return nil, err
+			}
+
+			matches, err := sameJSON(recorded, lobby.status)
+			if err != nil {
+				return nil, err
+			}
+
+			report.StatusRecorded = true
+			report.StatusMatches = matches
+			report.Diverged = report.Diverged || !matches
+		}
+	}
+
+	if lobby == nil {
+		return nil, errorNoTradeStarted
+	}
+
+	report.FinalStatus = lobby.status
+	return report, nil
+}
+
+func newReplayLobby(lobbyId string, snapshot lobbySnapshot) (*tradeLobby, error) {
+	numTrainers := len(snapshot.Trainers)
+	if numTrainers < 2 || len(snapshot.Items) != numTrainers || len(snapshot.Pokemons) != numTrainers ||
+		len(snapshot.Stats) != numTrainers || len(snapshot.Traders) != numTrainers ||
+		(len(snapshot.WithStats) != 0 && len(snapshot.WithStats) != numTrainers) {
+		return nil, errorInvalidSnapshot
+	}
+
+	lobby := newTradeLobby(lobbyId, snapshot.Trainers, &ws.TrackedInfo{})
+	copy(lobby.trainers, snapshot.Trainers)
+	lobby.availableItems = snapshot.Items
+	lobby.availablePokemons = snapshot.Pokemons
+	lobby.initialStats = snapshot.Stats
+	lobby.traders = snapshot.Traders
+	for trainerNum := range lobby.withStats {
+		lobby.withStats[trainerNum] = len(snapshot.WithStats) == 0 || snapshot.WithStats[trainerNum]
+	}
+	lobby.initStatus()
+	return lobby, nil
+}
+
+// replayMessage handles a recorded message again as the trainer sent it, at the time it was sent
+func (lobby *tradeLobby) replayMessage(event *auditEvent) (replayStep, error) {
+	trainerNum, ok := lobby.trainerNum(event.Trainer)
+	if !ok {
+		return replayStep{}, newPlayerNotExpectedError(event.Trainer)
+	}
+
+	recorded := messageAnswer{}
+	if err := remarshal(event.Data["answer"], &recorded); err != nil {
+		return replayStep{}, err
+	}
+
+	wsMsg := &ws.WebsocketMsg{}
+	if noContent, _ := event.Data["no_content"].(bool); !noContent {
+		wsMsg.Content = &ws.WebsocketMsgContent{
+			AppMsgType:   event.Action,
+			Data:         event.Data["message"],
+			RequestTrack: event.TrackInfo,
+		}
+	}
+
+	lobby.clock = func() time.Time {
+		return event.Timestamp
+	}
+
+	release := lobby.blockEscrow(trainerNum, event.Data["message"], recorded)
+	replayed := answerOf(lobby.handleMessage(wsMsg, lobby.status, trainerNum))
+	release()
+
+	return replayStep{
+		Action:   event.Action,
+		Trainer:  event.Trainer,
+		Recorded: recorded,
+		Replayed: replayed,
+		Matches:  recorded == replayed,
+	}, nil
+}
+
+// blockEscrow reproduces an item or pokemon having been offered in another trade when the
+// message was handled, since other lobbies are not part of the replay
+func (lobby *tradeLobby) blockEscrow(trainerNum int, data interface{}, recorded messageAnswer) func() {
+	var kind escrowKind
+	switch recorded.Code {
+	case codeItemInEscrow:
+		kind = escrowItem
+	case codePokemonInEscrow:
+		kind = escrowPokemon
+	default:
+		return func() {}
+	}
+
+	fields, _ := data.(map[string]interface{})
+	id, _ := field(fields, "ItemId").(string)
+	if kind == escrowPokemon {
+		id, _ = field(fields, "PokemonId").(string)
+	}
+
+	// approving a request offers what was requested
+	if requestId, ok := field(fields, "RequestId").(string); ok {
+		for _, request := range lobby.status.Requests {
+			if request.Id == requestId {
+				id = request.ItemId
+				if kind == escrowPokemon {
+					id = request.PokemonId
+				}
+			}
+		}
+	}
+
+	escrow.Lock(replayEscrowHolder, lobby.trainers[trainerNum], kind, id)
+	return func() {
+		escrow.ReleaseLobby(replayEscrowHolder)
+	}
+}
+
+// field looks up message data ignoring case, as messages are decoded
+func field(fields map[string]interface{}, name string) interface{} {
+	for key, value := range fields {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+
+	return nil
+}
+
+// remarshal converts what was decoded from the audit log into the type it was recorded from
+func remarshal(from interface{}, to interface{}) error {
+	fromBytes, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(fromBytes, to)
+}
+
+func sameJSON(a, b interface{}) (bool, error) {
+	aBytes, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+
+	bBytes, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(aBytes, bBytes), nil
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const recordedTradeFile = "testdata/recorded_trade.json"
+
+func TestReplayRecordedTrade(t *testing.T) {
+	config = defaultConfig()
+
+	out := &bytes.Buffer{}
+	if err := replayTrade(recordedTradeFile, out); err != nil {
+		t.Fatalf("replaying %s: %s\n%s", recordedTradeFile, err, out)
+	}
+
+	report := replayReport{}
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Steps) != 8 {
+		t.Errorf("replayed %d messages, recorded 8", len(report.Steps))
+	}
+
+	if !report.StatusRecorded || !report.StatusMatches {
+		t.Errorf("final status recorded %t, matches %t", report.StatusRecorded, report.StatusMatches)
+	}
+
+	if !report.FinalStatus.TradeFinished {
+		t.Error("replayed trade did not finish")
+	}
+
+	escrow.lock.Lock()
+	defer escrow.lock.Unlock()
+	for key, holder := range escrow.locks {
+		if holder == report.LobbyId {
+			t.Errorf("replay left %s %s of %s in escrow", key.kind, key.id, key.username)
+		}
+	}
+}
+
+func TestReplayDetectsDivergence(t *testing.T) {
+	config = defaultConfig()
+
+	eventsBytes, err := ioutil.ReadFile(recordedTradeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*auditEvent
+	if err = json.Unmarshal(eventsBytes, &events); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second trainer offering an item of the first one was refused when recorded
+	tampered := false
+	for _, event := range events {
+		if answer, ok := event.Data["answer"].(map[string]interface{}); ok && answer["code"] != nil {
+			event.Data["answer"] = messageAnswer{Type: "UPDATE"}
+			tampered = true
+			break
+		}
+	}
+	if !tampered {
+		t.Fatal("recorded trade has no refused message")
+	}
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tamperedFile := filepath.Join(dir, "tampered.json")
+	if eventsBytes, err = json.Marshal(events); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(tamperedFile, eventsBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = replayTrade(tamperedFile, ioutil.Discard)
+	if errors.Cause(err) != errorReplayDiverged {
+		t.Errorf("replaying a tampered log returned %v, expected %v", err, errorReplayDiverged)
+	}
+}
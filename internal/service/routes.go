@@ -0,0 +1,121 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/api"
+)
+
+const (
+	getLobbiesName   = "GET_TRADE_LOBBIES"
+	createTradeName  = "START_TRADE"
+	joinTradeName    = "JOIN_TRADE"
+	rejectTradeName  = "REJECT_TRADE"
+	tradeHistoryName = "GET_TRADE_HISTORY"
+	tradeAuditName   = "GET_TRADE_AUDIT"
+
+	createTradeOfferName  = "CREATE_TRADE_OFFER"
+	getTradeOffersName    = "GET_TRADE_OFFERS"
+	answerTradeOfferName  = "ANSWER_TRADE_OFFER"
+	acceptTradeOfferName  = "ACCEPT_TRADE_OFFER"
+	declineTradeOfferName = "DECLINE_TRADE_OFFER"
+	counterTradeOfferName = "COUNTER_TRADE_OFFER"
+)
+
+const (
+	usernameVar      = "username"
+	tradeHistoryPath = "/trades/history/{" + usernameVar + "}"
+
+	lobbyIdVar     = "lobbyId"
+	tradeAuditPath = "/trades/audit/{" + lobbyIdVar + "}"
+
+	offerIdVar            = "offerId"
+	tradeOffersPath       = "/trades/offers"
+	acceptTradeOfferPath  = tradeOffersPath + "/{" + offerIdVar + "}/accept"
+	declineTradeOfferPath = tradeOffersPath + "/{" + offerIdVar + "}/decline"
+	counterTradeOfferPath = tradeOffersPath + "/{" + offerIdVar + "}/counter"
+)
+
+const (
+	get  = "GET"
+	post = "POST"
+)
+
+var routes = utils.Routes{
+	genStatusRoute(),
+	utils.Route{
+		Name:        getLobbiesName,
+		Method:      get,
+		Pattern:     api.GetTradesPath,
+		HandlerFunc: handleGetLobbies,
+	},
+	utils.Route{
+		Name:        createTradeName,
+		Method:      post,
+		Pattern:     api.StartTradePath,
+		HandlerFunc: handleCreateTradeLobby,
+	},
+	utils.Route{
+		Name:        joinTradeName,
+		Method:      get,
+		Pattern:     api.JoinTradeRoute,
+		HandlerFunc: handleJoinTradeLobby,
+	},
+	utils.Route{
+		Name:        rejectTradeName,
+		Method:      post,
+		Pattern:     api.RejectTradeRoute,
+		HandlerFunc: handleRejectTradeLobby,
+	},
+	utils.Route{
+		Name:        tradeHistoryName,
+		Method:      get,
+		Pattern:     tradeHistoryPath,
+		HandlerFunc: handleGetTradeHistory,
+	},
+	utils.Route{
+		Name:        tradeAuditName,
+		Method:      get,
+		Pattern:     tradeAuditPath,
+		HandlerFunc: handleGetTradeAudit,
+	},
+	utils.Route{
+		Name:        createTradeOfferName,
+		Method:      post,
+		Pattern:     tradeOffersPath,
+		HandlerFunc: handleCreateTradeOffer,
+	},
+	utils.Route{
+		Name:        getTradeOffersName,
+		Method:      get,
+		Pattern:     tradeOffersPath,
+		HandlerFunc: handleGetTradeOffers,
+	},
+	utils.Route{
+		Name:        acceptTradeOfferName,
+		Method:      post,
+		Pattern:     acceptTradeOfferPath,
+		HandlerFunc: handleAcceptTradeOffer,
+	},
+	utils.Route{
+		Name:        declineTradeOfferName,
+		Method:      post,
+		Pattern:     declineTradeOfferPath,
+		HandlerFunc: handleDeclineTradeOffer,
+	},
+	utils.Route{
+		Name:        counterTradeOfferName,
+		Method:      post,
+		Pattern:     counterTradeOfferPath,
+		HandlerFunc: handleCounterTradeOffer,
+	},
+}
+
+// genStatusRoute keeps the standard status route but answers with the configuration in use
+func genStatusRoute() utils.Route {
+	route := api.GenStatusRoute(strings.ToLower(fmt.Sprintf("%s", serviceName)))
+	route.HandlerFunc = handleStatus
+	return route
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+)
+
+const tradesPerDayWindow = 24 * time.Hour
+
+// tradeRules decide what trainers may trade and are read from the rules section of the
+// configuration file. A rule left at its zero value is not enforced. Rarities map item names and
+// pokemon species to a rarity, so whole rarities can be made untradeable.
+//
+// The trainers service does not keep when an account was created, so MinTradingAge counts from
+// when trades first saw the trainer rather than from account creation. Enabling it holds back
+// every trainer, existing ones included, until they have been seen for that long. Acquisitions
+// are only known for what was received in trades.
+type tradeRules struct {
+	UntradeableItems    []string          `json:"untradeable_items"`
+	UntradeableSpecies  []string          `json:"untradeable_species"`
+	Rarities            map[string]string `json:"rarities"`
+	UntradeableRarities []string          `json:"untradeable_rarities"`
+	MinPokemonLevel     int               `json:"min_pokemon_level"`
+	MinTrainerLevel     int               `json:"min_trainer_level"`
+	MinTradingAge       duration          `json:"min_trading_age"`
+	AcquisitionCooldown duration          `json:"acquisition_cooldown"`
+	MaxTradesPerDay     int               `json:"max_trades_per_day"`
+}
+
+// traderRecord is what the rules need to know about a trainer, gathered when they join a trade.
+// Acquired has when each item and pokemon received in a recent trade arrived, by id.
+type traderRecord struct {
+	Level       int
+	FirstSeen   time.Time
+	TradesToday int
+	Acquired    map[string]time.Time
+}
+
+func (rules *tradeRules) validate() error {
+	if rules.MinPokemonLevel < 0 {
+		return newInvalidConfigError("rules.min_pokemon_level", "must not be negative")
+	}
+
+	if rules.MinTrainerLevel < 0 {
+		return newInvalidConfigError("rules.min_trainer_level", "must not be negative")
+	}
+
+	if rules.MinTradingAge < 0 {
+		return newInvalidConfigError("rules.min_trading_age", "must not be negative")
+	}
+
+	if rules.AcquisitionCooldown < 0 {
+		return newInvalidConfigError("rules.acquisition_cooldown", "must not be negative")
+	}
+
+	if rules.MaxTradesPerDay < 0 {
+		return newInvalidConfigError("rules.max_trades_per_day", "must not be negative")
+	}
+
+	return nil
+}
+
+// loadTraderRecord only looks at the trade history when a rule needs it. Trainers are always
+// registered as seen, so they have a trading age once the rule is enforced. now is the time the
+// rules are checked at.
+func (rules *tradeRules) loadTraderRecord(username string, stats utils.TrainerStats,
+	now time.Time) (traderRecord, error) {
+	firstSeen, err := accounts.FirstSeen(username, now)
+	if err != nil {
+		return traderRecord{}, err
+	}
+
+	record := traderRecord{
+		Level:     stats.Level,
+		FirstSeen: firstSeen,
+		Acquired:  map[string]time.Time{},
+	}
+
+	if rules.MaxTradesPerDay == 0 && rules.AcquisitionCooldown == 0 {
+		return record, nil
+	}
+
+	completed, err := history.ListByTrainer(username, tradeCompleted)
+	if err != nil {
+		return traderRecord{}, wrapTradeHistoryError(err)
+	}
+
+	cooldown := time.Duration(rules.AcquisitionCooldown)
+	for _, trade := range completed {
+		if now.Sub(trade.FinishedAt) < tradesPerDayWindow {
+			record.TradesToday++
+		}
+
+		if now.Sub(trade.FinishedAt) >= cooldown {
+			continue
+		}
+
+		entry := trade.toHistoryEntry(username)
+		for _, item := range entry.ItemsReceived {
+			record.Acquired[item.Id] = trade.FinishedAt
+		}
+		for _, pokemon := range entry.PokemonsReceived {
+			record.Acquired[pokemon.Id] = trade.FinishedAt
+		}
+	}
+
+	return record, nil
+}
+
+// checkTrader tells whether the trainer may trade at all, which is checked once per trade
+func (rules *tradeRules) checkTrader(record traderRecord, now time.Time) error {
+	if record.Level < rules.MinTrainerLevel {
+		return newRuleViolatedError(fmt.Sprintf("trainers below level %d can not trade", rules.MinTrainerLevel))
+	}
+
+	minAge := time.Duration(rules.MinTradingAge)
+	if age := now.Sub(record.FirstSeen); age < minAge {
+		return newRuleViolatedError(fmt.Sprintf("trainers can only trade %s after first using trades, %s left",
+			minAge, (minAge - age).Round(time.Second)))
+	}
+
+	if rules.MaxTradesPerDay > 0 && record.TradesToday >= rules.MaxTradesPerDay {
+		return newRuleViolatedError(fmt.Sprintf("trainers can not trade more than %d times a day",
+			rules.MaxTradesPerDay))
+	}
+
+	return nil
+}
+
+func (rules *tradeRules) checkItem(record traderRecord, item items.Item, now time.Time) error {
+	if contains(rules.UntradeableItems, item.Name) {
+		return newRuleViolatedError(fmt.Sprintf("%s can not be traded", item.Name))
+	}
+
+	if err := rules.checkRarity(item.Name); err != nil {
+		return err
+	}
+
+	return rules.checkCooldown(record, item.Id, now)
+}
+
+func (rules *tradeRules) checkPokemon(record traderRecord, pokemon pokemons.Pokemon, now time.Time) error {
+	if contains(rules.UntradeableSpecies, pokemon.Species) {
+		return newRuleViolatedError(fmt.Sprintf("%s can not be traded", pokemon.Species))
+	}
+
+	if pokemon.Level < rules.MinPokemonLevel {
+		return newRuleViolatedError(fmt.Sprintf("pokemons below level %d can not be traded",
+			rules.MinPokemonLevel))
+	}
+
+	if err := rules.checkRarity(pokemon.Species); err != nil {
+		return err
+	}
+
+	return rules.checkCooldown(record, pokemon.Id, now)
+}
+
+func (rules *tradeRules) checkRarity(name string) error {
+	rarity, ok := rules.Rarities[name]
+	if ok && contains(rules.UntradeableRarities, rarity) {
+		return newRuleViolatedError(fmt.Sprintf("%s is %s and can not be traded", name, rarity))
+	}
+
+	return nil
+}
+
+func (rules *tradeRules) checkCooldown(record traderRecord, id string, now time.Time) error {
+	acquiredAt, ok := record.Acquired[id]
+	if !ok {
+		return nil
+	}
+
+	available := acquiredAt.Add(time.Duration(rules.AcquisitionCooldown))
+	if now.Before(available) {
+		return newRuleViolatedError(fmt.Sprintf("%s was received in a trade and can not be traded for %s",
+			id, available.Sub(now).Round(time.Second)))
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+)
+
+func TestCheckTrader(t *testing.T) {
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	rules := tradeRules{
+		MinTrainerLevel: 2,
+		MinTradingAge:   duration(24 * time.Hour),
+		MaxTradesPerDay: 3,
+	}
+
+	tests := []struct {
+		name     string
+		record   traderRecord
+		violated bool
+	}{
+		{name: "allowed", record: traderRecord{Level: 2, FirstSeen: now.Add(-48 * time.Hour)}},
+		{name: "low level", record: traderRecord{Level: 1, FirstSeen: now.Add(-48 * time.Hour)}, violated: true},
+		{name: "new trader", record: traderRecord{Level: 2, FirstSeen: now.Add(-time.Hour)}, violated: true},
+		{name: "trader just old enough", record: traderRecord{Level: 2, FirstSeen: now.Add(-24 * time.Hour)}},
+		{
+			name:     "too many trades",
+			record:   traderRecord{Level: 2, FirstSeen: now.Add(-48 * time.Hour), TradesToday: 3},
+			violated: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := rules.checkTrader(test.record, now)
+			if test.violated && err == nil {
+				t.Error("trader was allowed to trade")
+			} else if !test.violated && err != nil {
+				t.Errorf("trader was not allowed to trade: %s", err)
+			}
+		})
+	}
+}
+
+func TestLoadTraderRecordKeepsFirstSeen(t *testing.T) {
+	accounts = &memoryAccounts{firstSeen: map[string]time.Time{}}
+
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	first, err := (&tradeRules{}).loadTraderRecord("ash", utils.TrainerStats{Level: 3}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !first.FirstSeen.Equal(now) {
+		t.Errorf("ash was first seen at %s, expected %s", first.FirstSeen, now)
+	}
+
+	now = now.Add(time.Hour)
+
+	second, err := (&tradeRules{}).loadTraderRecord("ash", utils.TrainerStats{Level: 3}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !second.FirstSeen.Equal(first.FirstSeen) {
+		t.Errorf("ash was first seen at %s and then at %s", first.FirstSeen, second.FirstSeen)
+	}
+}
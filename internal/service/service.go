@@ -0,0 +1,103 @@
+package service
+
+import (
+	"os"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/clients"
+	"github.com/golang/geo/s2"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	host        = utils.ServeHost
+	port        = utils.TradesPort
+	serviceName = "TRADES"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// Run starts the trades service, after recovering the commits a previous run left in the journal
+func Run() {
+	loadServerNames()
+
+	flags := utils.ParseFlags(serverName)
+
+	if !*flags.LogToStdout {
+		utils.SetLogFile(serverName)
+	}
+
+	loadedConfig, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = loadedConfig
+
+	location, exists := os.LookupEnv("LOCATION")
+	if !exists {
+		log.Fatal("no location in environment")
+	}
+
+	cellID := s2.CellIDFromToken(location)
+
+	if !*flags.DelayedComms {
+		commsManager = utils.CreateDefaultCommunicationManager()
+	} else {
+		commsManager = utils.CreateDefaultDelayedManager(false, &utils.OptionalConfigs{CellID: cellID})
+	}
+
+	notificationsClient = clients.NewNotificationClient(nil, commsManager, httpClient, basicClient)
+
+	fakes, err := useFakeServicesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fakes != nil {
+		log.Warn("using fake trainers and notifications services")
+	}
+
+	journal, err = newTradeJournalFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lobbies, err = newLobbyStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	history, err = newTradeHistoryFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	accounts, err = newAccountRegistryFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	offers, err = newOfferStoreFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	audit, err = newAuditLogFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *chaosFlag {
+		enableChaos(config.Chaos, fakes, journal)
+	}
+
+	trainersClient := newTrainersClient()
+	if err = recoverPendingTrades(trainersClient); err != nil {
+		log.Fatal(err)
+	}
+
+	utils.StartServer(serviceName, host, port, routes, commsManager)
+}
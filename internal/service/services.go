@@ -0,0 +1,102 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/NOVAPokemon/utils"
+	"github.com/NOVAPokemon/utils/clients"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	"github.com/NOVAPokemon/utils/tokens"
+	notificationMessages "github.com/NOVAPokemon/utils/websockets/notifications"
+)
+
+// trainersService is what trades need from the trainers service. Tokens are returned by the calls
+// fetching them, instead of kept in the client as clients.TrainersClient does.
+type trainersService interface {
+	GetTrainerByUsername(username string) (*utils.Trainer, error)
+	VerifyItems(username, hash, authToken string) (*bool, error)
+	VerifyPokemons(username string, hashes map[string]string, authToken string) (*bool, error)
+	VerifyTrainerStats(username, hash, authToken string) (*bool, error)
+	RemoveItems(username string, itemIds []string, authToken string) (map[string]items.Item, error)
+	AddItems(username string, toAdd []items.Item, authToken string) (map[string]items.Item, error)
+	AddPokemonToTrainer(username string, pokemon pokemons.Pokemon) (*pokemons.Pokemon, error)
+	RemovePokemonFromTrainer(username, pokemonId string) error
+	UpdateTrainerStats(username string, stats utils.TrainerStats, authToken string) (*utils.TrainerStats, error)
+	ItemsTokenFor(username, authToken string) (string, error)
+	PokemonTokensFor(username, authToken string) ([]string, error)
+	StatsTokenFor(username, authToken string) (string, error)
+}
+
+type notificationsService interface {
+	AddNotification(notification *notificationMessages.NotificationMessage, authToken string) error
+}
+
+// newTrainersClient gives every request its own client, since clients keep the tokens they fetch
+var newTrainersClient = func() trainersService {
+	return remoteTrainers{clients.NewTrainersClient(httpClient, commsManager, basicClient)}
+}
+
+// remoteTrainers is the trainers service reached through its client
+type remoteTrainers struct {
+	*clients.TrainersClient
+}
+
+func (t remoteTrainers) ItemsTokenFor(username, authToken string) (string, error) {
+	if err := t.GetItemsToken(username, authToken); err != nil {
+		return "", err
+	}
+
+	return t.ItemsToken, nil
+}
+
+func (t remoteTrainers) PokemonTokensFor(username, authToken string) ([]string, error) {
+	if err := t.GetPokemonsToken(username, authToken); err != nil {
+		return nil, err
+	}
+
+	pokemonTokens := make([]string, 0, len(t.PokemonTokens))
+	for _, pokemonToken := range t.PokemonTokens {
+		pokemonTokens = append(pokemonTokens, pokemonToken)
+	}
+
+	return pokemonTokens, nil
+}
+
+func (t remoteTrainers) StatsTokenFor(username, authToken string) (string, error) {
+	if err := t.GetTrainerStatsToken(username, authToken); err != nil {
+		return "", err
+	}
+
+	return t.TrainerStatsToken, nil
+}
+
+// tokenVerifier reads the tokens requests carry. Fake services replace it, since the tokens they
+// give out are made up.
+type tokenVerifier interface {
+	AuthToken(header http.Header) (*tokens.AuthToken, error)
+	ItemsToken(header http.Header) (*tokens.ItemsToken, error)
+	PokemonTokens(header http.Header) ([]*tokens.PokemonToken, error)
+	StatsToken(header http.Header) (*tokens.TrainerStatsToken, error)
+}
+
+var verifier tokenVerifier = signedTokens{}
+
+// signedTokens are the tokens signed by the authentication and trainers services
+type signedTokens struct{}
+
+func (signedTokens) AuthToken(header http.Header) (*tokens.AuthToken, error) {
+	return tokens.ExtractAndVerifyAuthToken(header)
+}
+
+func (signedTokens) ItemsToken(header http.Header) (*tokens.ItemsToken, error) {
+	return tokens.ExtractAndVerifyItemsToken(header)
+}
+
+func (signedTokens) PokemonTokens(header http.Header) ([]*tokens.PokemonToken, error) {
+	return tokens.ExtractAndVerifyPokemonTokens(header)
+}
+
+func (signedTokens) StatsToken(header http.Header) (*tokens.TrainerStatsToken, error) {
+	return tokens.ExtractAndVerifyTrainerStatsToken(header)
+}
@@ -0,0 +1,786 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/NOVAPokemon/utils"
+	errors2 "github.com/NOVAPokemon/utils/clients/errors"
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	ws "github.com/NOVAPokemon/utils/websockets"
+	"github.com/NOVAPokemon/utils/websockets/trades"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+type pokemonsMap = map[string]pokemons.Pokemon
+
+// tradePlayer mirrors trades.Player with the pokemons and coins offered alongside the items. The
+// recipients map the id of each item and pokemon offered to the trainer receiving it. A trainer
+// at a disadvantage, by the values of what they give and receive, must have confirmed the trade
+// besides accepting it.
+type tradePlayer struct {
+	Username          string
+	Items             []items.Item
+	Pokemons          []pokemons.Pokemon
+	ItemRecipients    map[string]string
+	PokemonRecipients map[string]string
+	Coins             int
+	CoinsRecipient    string
+	GivenValue        int
+	ReceivedValue     int
+	Disadvantaged     bool
+	Confirmed         bool
+	Accepted          bool
+}
+
+type tradeStatus struct {
+	Players       []tradePlayer
+	Requests      []tradeRequest
+	TradeFinished bool
+}
+
+// trainerInventory is what a trainer brings to a trade, taken from the tokens sent when joining
+type trainerInventory struct {
+	items         trades.ItemsMap
+	itemsHash     string
+	pokemons      pokemonsMap
+	pokemonHashes map[string]string
+	stats         utils.TrainerStats
+	statsHash     string
+	record        traderRecord
+}
+
+// tradeLobby holds a trade between the expected trainers. Once they join, trainers are numbered
+// by the order they joined in, which indexes everything kept per trainer.
+type tradeLobby struct {
+	expected []string
+	trainers []string
+	joinLock sync.Mutex
+	wsLobby  *ws.Lobby
+	status   *tradeStatus
+
+	availableItems    []trades.ItemsMap
+	availablePokemons []pokemonsMap
+	itemsLock         sync.Mutex
+
+	initialHashes        []string
+	initialPokemonHashes []map[string]string
+	initialStats         []utils.TrainerStats
+	initialStatsHashes   []string
+	withStats            []bool
+	traders              []traderRecord
+
+	authTokens []string
+	tokensLock sync.Mutex
+
+	initialized int32
+	createdAt   time.Time
+
+	// clock tells the time rules are checked at, which a replay sets to when each message was
+	// handled
+	clock func() time.Time
+
+	strikes []int
+
+	// conns and disconnected are only touched by the trade main loop while it runs
+	conns        []*trainerConn
+	disconnected []bool
+	incoming     chan trainerMessage
+	drops        chan droppedConn
+	graceExpired chan int
+	resumes      chan resumeRequest
+	finished     chan struct{}
+	finishOnce   sync.Once
+
+	rejected chan struct{}
+	reject   sync.Once
+}
+
+func newTradeLobby(lobbyId string, expected []string, trackedInfo *ws.TrackedInfo) *tradeLobby {
+	numTrainers := len(expected)
+	return &tradeLobby{
+		expected:             expected,
+		trainers:             make([]string, numTrainers),
+		wsLobby:              ws.NewLobby(lobbyId, numTrainers, trackedInfo),
+		availableItems:       make([]trades.ItemsMap, numTrainers),
+		availablePokemons:    make([]pokemonsMap, numTrainers),
+		initialHashes:        make([]string, numTrainers),
+		initialPokemonHashes: make([]map[string]string, numTrainers),
+		initialStats:         make([]utils.TrainerStats, numTrainers),
+		initialStatsHashes:   make([]string, numTrainers),
+		withStats:            make([]bool, numTrainers),
+		traders:              make([]traderRecord, numTrainers),
+		authTokens:           make([]string, numTrainers),
+		createdAt:            time.Now(),
+		clock:                time.Now,
+		strikes:              make([]int, numTrainers),
+		conns:                make([]*trainerConn, numTrainers),
+		disconnected:         make([]bool, numTrainers),
+		incoming:             make(chan trainerMessage),
+		drops:                make(chan droppedConn),
+		graceExpired:         make(chan int),
+		resumes:              make(chan resumeRequest),
+		finished:             make(chan struct{}),
+		rejected:             make(chan struct{}),
+	}
+}
+
+func (lobby *tradeLobby) addTrainer(username string, inventory trainerInventory, authToken string,
+	trainerConn *websocket.Conn, manager ws.CommunicationManager) (int, error) {
+	lobby.joinLock.Lock()
+	defer lobby.joinLock.Unlock()
+
+	if _, joined := lobby.trainerNum(username); joined {
+		return -1, newPlayerAlreadyJoinedError(username)
+	}
+
+	trainersJoined, err := ws.AddTrainer(lobby.wsLobby, username, trainerConn, manager)
+	if err != nil {
+		return -1, errors2.WrapAddTrainerError(err)
+	}
+
+	trainerNum := trainersJoined - 1
+	lobby.trainers[trainerNum] = username
+
+	lobby.itemsLock.Lock()
+	lobby.availableItems[trainerNum] = inventory.items
+	lobby.availablePokemons[trainerNum] = inventory.pokemons
+	lobby.itemsLock.Unlock()
+
+	lobby.tokensLock.Lock()
+	lobby.authTokens[trainerNum] = authToken
+	lobby.tokensLock.Unlock()
+
+	lobby.initialHashes[trainerNum] = inventory.itemsHash
+	lobby.initialPokemonHashes[trainerNum] = inventory.pokemonHashes
+	lobby.initialStats[trainerNum] = inventory.stats
+	lobby.initialStatsHashes[trainerNum] = inventory.statsHash
+	lobby.withStats[trainerNum] = inventory.statsHash != ""
+	lobby.traders[trainerNum] = inventory.record
+	return trainersJoined, nil
+}
+
+// trainerNum finds a trainer that joined the lobby
+func (lobby *tradeLobby) trainerNum(username string) (int, bool) {
+	for trainerNum, trainer := range lobby.trainers {
+		if trainer == username {
+			return trainerNum, true
+		}
+	}
+
+	return -1, false
+}
+
+// holds tells whether the trainer created the lobby or joined it, which is what counts towards the
+// lobbies a trainer may have. Being invited does not.
+func (lobby *tradeLobby) holds(username string) bool {
+	if lobby.expected[0] == username {
+		return true
+	}
+
+	lobby.joinLock.Lock()
+	defer lobby.joinLock.Unlock()
+	_, joined := lobby.trainerNum(username)
+	return joined
+}
+
+func (lobby *tradeLobby) isExpected(username string) bool {
+	for _, trainer := range lobby.expected {
+		if trainer == username {
+			return true
+		}
+	}
+
+	return false
+}
+
+// participants are the trainers in the order the trade refers to them, or the invited ones if
+// the trade never started
+func (lobby *tradeLobby) participants() []string {
+	if lobby.status == nil {
+		return lobby.expected
+	}
+
+	return lobby.trainers
+}
+
+func (lobby *tradeLobby) startTrade() error {
+	lobby.initStatus()
+	recordAuditEvent(lobby.wsLobby.Id, auditTradeStarted, "",
+		map[string]interface{}{"snapshot": lobby.snapshot()}, lobby.wsLobby.StartTrackInfo)
+
+	for i := range lobby.conns {
+		lobby.conns[i] = newLobbyConn(lobby.wsLobby, i, lobby.finished)
+		lobby.watch(i, lobby.conns[i])
+	}
+	return lobby.tradeMainLoop()
+}
+
+// initStatus starts the trade with nothing offered
+func (lobby *tradeLobby) initStatus() {
+	players := make([]tradePlayer, len(lobby.trainers))
+	for i := range players {
+		players[i] = tradePlayer{
+			Username:          lobby.trainers[i],
+			Items:             []items.Item{},
+			Pokemons:          []pokemons.Pokemon{},
+			ItemRecipients:    map[string]string{},
+			PokemonRecipients: map[string]string{},
+			Accepted:          false,
+		}
+	}
+
+	lobby.status = &tradeStatus{
+		Players:  players,
+		Requests: []tradeRequest{},
+	}
+}
+
+func (lobby *tradeLobby) tradeMainLoop() error {
+	wsLobby := lobby.wsLobby
+	lobby.sendToAll(trades.StartTradeMessage{}.ConvertToWSMessage(*lobby.wsLobby.StartTrackInfo))
+	lobby.sendToAll(lobby.inventoriesMessage().ConvertToWSMessage())
+	ws.StartLobby(wsLobby)
+	emitTradeStart()
+
+	inactivityTimeout := time.Duration(config.InactivityTimeout)
+	maxTradeDuration := time.Duration(config.MaxTradeDuration)
+	warning := time.Duration(config.TimeoutWarning)
+
+	idleWarningTimer := time.NewTimer(inactivityTimeout - warning)
+	defer idleWarningTimer.Stop()
+	idleTimer := time.NewTimer(inactivityTimeout)
+	defer idleTimer.Stop()
+
+	deadlineWarningTimer := time.NewTimer(maxTradeDuration - warning)
+	defer deadlineWarningTimer.Stop()
+	deadlineTimer := time.NewTimer(maxTradeDuration)
+	defer deadlineTimer.Stop()
+
+	graceTimers := make([]*time.Timer, len(lobby.conns))
+	defer func() {
+		for _, timer := range graceTimers {
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}()
+
+	var received trainerMessage
+	for {
+		select {
+		case received = <-lobby.incoming:
+		case dropped := <-lobby.drops:
+			trainerNum := dropped.trainerNum
+			if dropped.conn == lobby.conns[trainerNum] && !lobby.disconnected[trainerNum] {
+				graceTimers[trainerNum] = lobby.disconnect(trainerNum)
+			}
+			continue
+		case trainerNum := <-lobby.graceExpired:
+			// the timer may have fired just as the trainer resumed
+			if lobby.disconnected[trainerNum] {
+				return errorTrainerDisconnected
+			}
+			continue
+		case request := <-lobby.resumes:
+			if lobby.reconnect(request) {
+				graceTimers[request.trainerNum].Stop()
+			}
+			continue
+		case <-idleWarningTimer.C:
+			lobby.warnTimeout(codeTradeInactive, warning)
+			continue
+		case <-idleTimer.C:
+			return errorTradeInactive
+		case <-deadlineWarningTimer.C:
+			lobby.warnTimeout(codeTradeExpired, warning)
+			continue
+		case <-deadlineTimer.C:
+			return errorTradeExpired
+		}
+
+		resetTimer(idleWarningTimer, inactivityTimeout-warning)
+		resetTimer(idleTimer, inactivityTimeout)
+
+		lobby.handleChannelMessage(received.msg, lobby.status, received.trainerNum)
+
+		if lobby.exceededViolations(received.trainerNum) {
+			return errorTooManyViolations
+		}
+
+		if lobby.status.TradeFinished {
+			return nil
+		}
+	}
+}
+
+// disconnect keeps the trade going while the trainer has time to resume it, and tells the other
+// trainers to wait
+func (lobby *tradeLobby) disconnect(trainerNum int) *time.Timer {
+	grace := time.Duration(config.ReconnectGrace)
+	log.Warnf("trainer %s disconnected from lobby %s, waiting %s to resume", lobby.trainers[trainerNum],
+		lobby.wsLobby.Id, grace)
+
+	lobby.disconnected[trainerNum] = true
+	recordAuditEvent(lobby.wsLobby.Id, auditTrainerDisconnected, lobby.trainers[trainerNum], nil, nil)
+	lobby.sendTo(TrainerConnectionMessage{
+		Username:  lobby.trainers[trainerNum],
+		ExpiresIn: int(grace.Seconds()),
+	}.ConvertToWSMessage(TrainerDisconnected), lobby.others(trainerNum)...)
+
+	return time.AfterFunc(grace, func() {
+		select {
+		case lobby.graceExpired <- trainerNum:
+		case <-lobby.finished:
+		}
+	})
+}
+
+// reconnect swaps in the connection of a trainer resuming the trade and sends them everything
+// they need to continue where they left off
+func (lobby *tradeLobby) reconnect(request resumeRequest) bool {
+	trainerNum := request.trainerNum
+	if !lobby.disconnected[trainerNum] {
+		request.accepted <- false
+		return false
+	}
+
+	lobby.conns[trainerNum].close()
+	lobby.conns[trainerNum] = request.conn
+	lobby.disconnected[trainerNum] = false
+	lobby.watch(trainerNum, request.conn)
+	request.accepted <- true
+
+	log.Infof("trainer %s resumed trade in lobby %s", lobby.trainers[trainerNum], lobby.wsLobby.Id)
+	recordAuditEvent(lobby.wsLobby.Id, auditTrainerReconnected, lobby.trainers[trainerNum], nil, nil)
+
+	trackInfo := *lobby.wsLobby.StartTrackInfo
+	lobby.sendTo(trades.StartTradeMessage{}.ConvertToWSMessage(trackInfo), trainerNum)
+	lobby.sendTo(lobby.inventoriesMessage().ConvertToWSMessage(), trainerNum)
+	lobby.sendTo(updateMessageFromTrade(lobby.status).ConvertToWSMessage(trackInfo), trainerNum)
+	lobby.sendTo(TrainerConnectionMessage{
+		Username: lobby.trainers[trainerNum],
+	}.ConvertToWSMessage(TrainerReconnected), lobby.others(trainerNum)...)
+
+	return true
+}
+
+func (lobby *tradeLobby) warnTimeout(reason errorCode, expiresIn time.Duration) {
+	warningMsg := TimeoutWarningMessage{
+		Reason:    reason,
+		ExpiresIn: int(expiresIn.Seconds()),
+	}.ConvertToWSMessage()
+	lobby.sendToAll(warningMsg)
+}
+
+func (lobby *tradeLobby) finish() {
+	lobby.finishWithSuccess(true)
+}
+
+func (lobby *tradeLobby) finishWithError(code errorCode, info string) {
+	errorMsg := ErrorTradeMessage{
+		Code:  code,
+		Info:  info,
+		Fatal: true,
+	}.ConvertToWSMessage(*lobby.wsLobby.StartTrackInfo)
+	lobby.sendToAll(errorMsg)
+	lobby.finishWithSuccess(false)
+}
+
+func (lobby *tradeLobby) finishWithSuccess(success bool) {
+	lobby.sendToAll(ws.FinishMessage{Success: success}.ConvertToWSMessage())
+
+	wg := sync.WaitGroup{}
+	for _, conn := range lobby.conns {
+		wg.Add(1)
+		dropped := conn.dropped
+		go func() {
+			defer wg.Done()
+			select {
+			case <-dropped:
+			case <-time.After(time.Duration(config.FinishTimeout)):
+			}
+		}()
+	}
+	wg.Wait()
+
+	ws.FinishLobby(lobby.wsLobby)
+	lobby.closeConns()
+}
+
+func (lobby *tradeLobby) sendTokensToUser(tokensString []string, trainerNum int) {
+	setTokenMsg := ws.SetTokenMessage{TokensString: tokensString}
+	lobby.sendTo(setTokenMsg.ConvertToWSMessage(), trainerNum)
+}
+
+func (lobby *tradeLobby) handleChannelMessage(wsMsg *ws.WebsocketMsg, status *tradeStatus, trainerNum int) {
+	answerMsg := lobby.handleMessage(wsMsg, status, trainerNum)
+	lobby.auditMessage(wsMsg, trainerNum, answerMsg)
+
+	if answerMsg == nil {
+		return
+	}
+
+	switch answerMsg.Content.AppMsgType {
+	case ws.Error:
+		lobby.sendTo(answerMsg, trainerNum)
+	case trades.Update:
+		lobby.sendToAll(answerMsg)
+	}
+}
+
+func (lobby *tradeLobby) handleMessage(wsMsg *ws.WebsocketMsg, status *tradeStatus,
+	trainerNum int) *ws.WebsocketMsg {
+	content := wsMsg.Content
+	if content == nil || content.RequestTrack == nil {
+		return lobby.protocolViolation(ws.TrackedInfo{}, trainerNum, codeInvalidMessage, errorMissingTrackInfo)
+	}
+
+	msgData := content.Data
+	trackInfo := *content.RequestTrack
+	switch content.AppMsgType {
+	case trades.Trade:
+		tradeMsg := &TradeItemMessage{}
+		if err := decodeMessageData(msgData, tradeMsg, &tradeMsg.ItemId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleTradeMessage(content.RequestTrack, tradeMsg, status, trainerNum)
+	case RemoveItem:
+		removeMsg := &RemoveItemMessage{}
+		if err := decodeMessageData(msgData, removeMsg, &removeMsg.ItemId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleRemoveItemMessage(content.RequestTrack, removeMsg, status, trainerNum)
+	case TradePokemon:
+		tradePokemonMsg := &TradePokemonMessage{}
+		if err := decodeMessageData(msgData, tradePokemonMsg, &tradePokemonMsg.PokemonId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleTradePokemonMessage(content.RequestTrack, tradePokemonMsg, status, trainerNum)
+	case RemovePokemon:
+		removePokemonMsg := &RemovePokemonMessage{}
+		if err := decodeMessageData(msgData, removePokemonMsg, &removePokemonMsg.PokemonId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleRemovePokemonMessage(content.RequestTrack, removePokemonMsg, status, trainerNum)
+	case OfferCoins:
+		coinsMsg := &OfferCoinsMessage{}
+		if err := decodeMessageData(msgData, coinsMsg); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleOfferCoinsMessage(content.RequestTrack, coinsMsg, status, trainerNum)
+	case RequestItem:
+		requestMsg := &RequestItemMessage{}
+		if err := decodeMessageData(msgData, requestMsg, &requestMsg.ItemId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleRequestItemMessage(content.RequestTrack, requestMsg, status, trainerNum)
+	case RequestPokemon:
+		requestPokemonMsg := &RequestPokemonMessage{}
+		if err := decodeMessageData(msgData, requestPokemonMsg, &requestPokemonMsg.PokemonId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleRequestPokemonMessage(content.RequestTrack, requestPokemonMsg, status, trainerNum)
+	case ApproveRequest, DeclineRequest:
+		answerMsg := &AnswerRequestMessage{}
+		if err := decodeMessageData(msgData, answerMsg, &answerMsg.RequestId); err != nil {
+			return lobby.protocolViolation(trackInfo, trainerNum, codeInvalidMessage, err)
+		}
+		return lobby.handleAnswerRequestMessage(content.RequestTrack, answerMsg, status, trainerNum,
+			content.AppMsgType == ApproveRequest)
+	case trades.Accept:
+		return lobby.handleAcceptMessage(content.RequestTrack, status, trainerNum)
+	case ConfirmTrade:
+		return lobby.handleConfirmMessage(content.RequestTrack, status, trainerNum)
+	case Unaccept:
+		return lobby.handleUnacceptMessage(content.RequestTrack, status, trainerNum)
+	default:
+		return lobby.protocolViolation(trackInfo, trainerNum, codeUnknownMessageType,
+			newInvalidMessageTypeError(content.AppMsgType))
+	}
+}
+
+func (lobby *tradeLobby) handleTradeMessage(trackInfo *ws.TrackedInfo, tradeMsg *TradeItemMessage,
+	trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	return lobby.offerItem(trackInfo, trade, trainerNum, tradeMsg.ItemId, tradeMsg.Recipient)
+}
+
+// offerItem adds an item of the trainer to their offer, going to recipient
+func (lobby *tradeLobby) offerItem(trackInfo *ws.TrackedInfo, trade *tradeStatus, trainerNum int,
+	itemId, recipientName string) *ws.WebsocketMsg {
+
+	lobby.itemsLock.Lock()
+	item, ok := lobby.availableItems[trainerNum][itemId]
+	lobby.itemsLock.Unlock()
+
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeItemNotOwned,
+			Info:  fmt.Sprintf("you dont have %s", itemId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	} else {
+		for _, itemAdded := range trade.Players[trainerNum].Items {
+			if itemAdded.Id == itemId {
+				return ErrorTradeMessage{
+					Code:  codeItemAlreadyOffered,
+					Info:  fmt.Sprintf("you already added %s", itemId),
+					Fatal: false,
+				}.ConvertToWSMessage(*trackInfo)
+			}
+		}
+	}
+
+	if err := config.Rules.checkItem(lobby.traders[trainerNum], item, lobby.clock()); err != nil {
+		return ErrorTradeMessage{
+			Code:  codeTradeRuleViolated,
+			Info:  err.Error(),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if offerSize(&trade.Players[trainerNum]) >= config.MaxItemsPerOffer {
+		return ErrorTradeMessage{
+			Code:  codeOfferTooLarge,
+			Info:  fmt.Sprintf("offers can not have more than %d items", config.MaxItemsPerOffer),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	recipient, ok := lobby.counterparty(trainerNum, recipientName)
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeInvalidRecipient,
+			Info:  fmt.Sprintf("%s can not receive %s", recipientName, itemId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if !escrow.Lock(lobby.wsLobby.Id, lobby.trainers[trainerNum], escrowItem, itemId) {
+		return ErrorTradeMessage{
+			Code:  codeItemInEscrow,
+			Info:  fmt.Sprintf("%s is offered in another trade", itemId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	trade.Players[trainerNum].Items = append(trade.Players[trainerNum].Items, item)
+	trade.Players[trainerNum].ItemRecipients[itemId] = recipient
+	resetAcceptance(trade)
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}
+
+func (lobby *tradeLobby) handleRemoveItemMessage(trackInfo *ws.TrackedInfo, removeMsg *RemoveItemMessage,
+	trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	itemId := removeMsg.ItemId
+
+	lobby.itemsLock.Lock()
+	_, ok := lobby.availableItems[trainerNum][itemId]
+	lobby.itemsLock.Unlock()
+
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeItemNotOwned,
+			Info:  fmt.Sprintf("you dont have %s", itemId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	offered := trade.Players[trainerNum].Items
+	for i, itemAdded := range offered {
+		if itemAdded.Id == itemId {
+			trade.Players[trainerNum].Items = append(offered[:i:i], offered[i+1:]...)
+			delete(trade.Players[trainerNum].ItemRecipients, itemId)
+			escrow.Release(lobby.wsLobby.Id, lobby.trainers[trainerNum], escrowItem, itemId)
+			reopenRequests(trade, lobby.trainers[trainerNum], itemId, "")
+			resetAcceptance(trade)
+			return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+		}
+	}
+
+	return ErrorTradeMessage{
+		Code:  codeItemNotOffered,
+		Info:  fmt.Sprintf("you have not added %s", itemId),
+		Fatal: false,
+	}.ConvertToWSMessage(*trackInfo)
+}
+
+func (lobby *tradeLobby) handleTradePokemonMessage(trackInfo *ws.TrackedInfo, tradeMsg *TradePokemonMessage,
+	trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	return lobby.offerPokemon(trackInfo, trade, trainerNum, tradeMsg.PokemonId, tradeMsg.Recipient)
+}
+
+// offerPokemon adds a pokemon of the trainer to their offer, going to recipient
+func (lobby *tradeLobby) offerPokemon(trackInfo *ws.TrackedInfo, trade *tradeStatus, trainerNum int,
+	pokemonId, recipientName string) *ws.WebsocketMsg {
+
+	lobby.itemsLock.Lock()
+	pokemon, ok := lobby.availablePokemons[trainerNum][pokemonId]
+	lobby.itemsLock.Unlock()
+
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codePokemonNotOwned,
+			Info:  fmt.Sprintf("you dont have pokemon %s", pokemonId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	} else {
+		for _, pokemonAdded := range trade.Players[trainerNum].Pokemons {
+			if pokemonAdded.Id == pokemonId {
+				return ErrorTradeMessage{
+					Code:  codePokemonAlreadyOffered,
+					Info:  fmt.Sprintf("you already added pokemon %s", pokemonId),
+					Fatal: false,
+				}.ConvertToWSMessage(*trackInfo)
+			}
+		}
+	}
+
+	if err := config.Rules.checkPokemon(lobby.traders[trainerNum], pokemon, lobby.clock()); err != nil {
+		return ErrorTradeMessage{
+			Code:  codeTradeRuleViolated,
+			Info:  err.Error(),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if offerSize(&trade.Players[trainerNum]) >= config.MaxItemsPerOffer {
+		return ErrorTradeMessage{
+			Code:  codeOfferTooLarge,
+			Info:  fmt.Sprintf("offers can not have more than %d items", config.MaxItemsPerOffer),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	recipient, ok := lobby.counterparty(trainerNum, recipientName)
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codeInvalidRecipient,
+			Info:  fmt.Sprintf("%s can not receive pokemon %s", recipientName, pokemonId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	if !escrow.Lock(lobby.wsLobby.Id, lobby.trainers[trainerNum], escrowPokemon, pokemonId) {
+		return ErrorTradeMessage{
+			Code:  codePokemonInEscrow,
+			Info:  fmt.Sprintf("pokemon %s is offered in another trade", pokemonId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	trade.Players[trainerNum].Pokemons = append(trade.Players[trainerNum].Pokemons, pokemon)
+	trade.Players[trainerNum].PokemonRecipients[pokemonId] = recipient
+	resetAcceptance(trade)
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}
+
+func (lobby *tradeLobby) handleRemovePokemonMessage(trackInfo *ws.TrackedInfo, removeMsg *RemovePokemonMessage,
+	trade *tradeStatus, trainerNum int) *ws.WebsocketMsg {
+	pokemonId := removeMsg.PokemonId
+
+	lobby.itemsLock.Lock()
+	_, ok := lobby.availablePokemons[trainerNum][pokemonId]
+	lobby.itemsLock.Unlock()
+
+	if !ok {
+		return ErrorTradeMessage{
+			Code:  codePokemonNotOwned,
+			Info:  fmt.Sprintf("you dont have pokemon %s", pokemonId),
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	offered := trade.Players[trainerNum].Pokemons
+	for i, pokemonAdded := range offered {
+		if pokemonAdded.Id == pokemonId {
+			trade.Players[trainerNum].Pokemons = append(offered[:i:i], offered[i+1:]...)
+			delete(trade.Players[trainerNum].PokemonRecipients, pokemonId)
+			escrow.Release(lobby.wsLobby.Id, lobby.trainers[trainerNum], escrowPokemon, pokemonId)
+			reopenRequests(trade, lobby.trainers[trainerNum], "", pokemonId)
+			resetAcceptance(trade)
+			return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+		}
+	}
+
+	return ErrorTradeMessage{
+		Code:  codePokemonNotOffered,
+		Info:  fmt.Sprintf("you have not added pokemon %s", pokemonId),
+		Fatal: false,
+	}.ConvertToWSMessage(*trackInfo)
+}
+
+func (lobby *tradeLobby) handleAcceptMessage(trackInfo *ws.TrackedInfo, trade *tradeStatus,
+	trainerNum int) *ws.WebsocketMsg {
+	trade.Players[trainerNum].Accepted = true
+
+	if checkIfTradeFinished(trade) {
+		trade.TradeFinished = true
+	}
+
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}
+
+func (lobby *tradeLobby) handleUnacceptMessage(trackInfo *ws.TrackedInfo, trade *tradeStatus,
+	trainerNum int) *ws.WebsocketMsg {
+	trade.Players[trainerNum].Accepted = false
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+func updateClients(msg *ws.WebsocketMsg, sendTo ...chan *ws.WebsocketMsg) {
+	for _, channel := range sendTo {
+		channel <- msg
+	}
+}
+
+// resetAcceptance clears both acceptances so a trade is only finished when both trainers
+// accepted the same final offers, which are valued again.
+func resetAcceptance(trade *tradeStatus) {
+	for i := range trade.Players {
+		trade.Players[i].Accepted = false
+	}
+
+	assessFairness(trade)
+}
+
+// counterparty validates the trainer an offer goes to, or a request is made to. Trades between
+// two trainers may leave it out, since it can only be the other trainer.
+func (lobby *tradeLobby) counterparty(trainerNum int, username string) (string, bool) {
+	if username == "" {
+		if len(lobby.trainers) != 2 {
+			return "", false
+		}
+		return lobby.trainers[(trainerNum+1)%2], true
+	}
+
+	counterpartyNum, ok := lobby.trainerNum(username)
+	return username, ok && counterpartyNum != trainerNum
+}
+
+// offerSize counts both items and pokemons, which share the same limit
+func offerSize(player *tradePlayer) int {
+	return len(player.Items) + len(player.Pokemons)
+}
+
+func checkIfTradeFinished(trade *tradeStatus) bool {
+	for _, player := range trade.Players {
+		if !player.Accepted || (player.Disadvantaged && !player.Confirmed) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"github.com/NOVAPokemon/utils/items"
+	"github.com/NOVAPokemon/utils/pokemons"
+	ws "github.com/NOVAPokemon/utils/websockets"
+)
+
+// tradeValues price what is offered in a trade, in coins, and are read from the values section of
+// the configuration file. Items are priced by name and pokemons by species plus a value per level,
+// falling back to the defaults. A trainer set to lose more than FairnessThreshold of the value they
+// give must confirm the trade before it finishes, and a threshold of zero turns the check off.
+type tradeValues struct {
+	Items             map[string]int `json:"items"`
+	Species           map[string]int `json:"species"`
+	DefaultItem       int            `json:"default_item"`
+	DefaultPokemon    int            `json:"default_pokemon"`
+	PokemonLevel      int            `json:"pokemon_level"`
+	FairnessThreshold float64        `json:"fairness_threshold"`
+}
+
+func defaultTradeValues() tradeValues {
+	return tradeValues{
+		DefaultItem:       100,
+		DefaultPokemon:    500,
+		PokemonLevel:      50,
+		FairnessThreshold: 0.5,
+	}
+}
+
+func (values *tradeValues) validate() error {
+	if values.DefaultItem < 0 || values.DefaultPokemon < 0 || values.PokemonLevel < 0 {
+		return newInvalidConfigError("values", "must not be negative")
+	}
+
+	for _, table := range []map[string]int{values.Items, values.Species} {
+		for _, value := range table {
+			if value < 0 {
+				return newInvalidConfigError("values", "must not be negative")
+			}
+		}
+	}
+
+	if values.FairnessThreshold < 0 || values.FairnessThreshold > 1 {
+		return newInvalidConfigError("values.fairness_threshold", "must be between 0 and 1")
+	}
+
+	return nil
+}
+
+func (values *tradeValues) itemValue(item items.Item) int {
+	if value, ok := values.Items[item.Name]; ok {
+		return value
+	}
+
+	return values.DefaultItem
+}
+
+func (values *tradeValues) pokemonValue(pokemon pokemons.Pokemon) int {
+	value, ok := values.Species[pokemon.Species]
+	if !ok {
+		value = values.DefaultPokemon
+	}
+
+	return value + pokemon.Level*values.PokemonLevel
+}
+
+// assessFairness values what every trainer gives and receives, and flags the trainers at a
+// disadvantage. Any change to the offers clears previous confirmations.
+func assessFairness(trade *tradeStatus) {
+	trainers := make([]string, len(trade.Players))
+	itemRecipients := make([]map[string]string, len(trade.Players))
+	pokemonRecipients := make([]map[string]string, len(trade.Players))
+	coinsRecipients := make([]string, len(trade.Players))
+	for i, player := range trade.Players {
+		trainers[i] = player.Username
+		itemRecipients[i] = player.ItemRecipients
+		pokemonRecipients[i] = player.PokemonRecipients
+		coinsRecipients[i] = player.CoinsRecipient
+	}
+
+	given := make([]int, len(trade.Players))
+	received := make([]int, len(trade.Players))
+	for giver, player := range trade.Players {
+		for _, item := range player.Items {
+			value := config.Values.itemValue(item)
+			given[giver] += value
+			received[transferRecipient(trainers, itemRecipients, giver, item.Id)] += value
+		}
+
+		for _, pokemon := range player.Pokemons {
+			value := config.Values.pokemonValue(pokemon)
+			given[giver] += value
+			received[transferRecipient(trainers, pokemonRecipients, giver, pokemon.Id)] += value
+		}
+
+		if player.Coins > 0 {
+			given[giver] += player.Coins
+			received[coinsRecipient(trainers, coinsRecipients, giver)] += player.Coins
+		}
+	}
+
+	threshold := config.Values.FairnessThreshold
+	for i := range trade.Players {
+		player := &trade.Players[i]
+		player.GivenValue = given[i]
+		player.ReceivedValue = received[i]
+		player.Disadvantaged = threshold > 0 && given[i] > 0 &&
+			float64(given[i]-received[i]) > threshold*float64(given[i])
+		player.Confirmed = false
+	}
+}
+
+// handleConfirmMessage lets a trainer at a disadvantage agree to the trade anyway
+func (lobby *tradeLobby) handleConfirmMessage(trackInfo *ws.TrackedInfo, trade *tradeStatus,
+	trainerNum int) *ws.WebsocketMsg {
+	player := &trade.Players[trainerNum]
+	if !player.Disadvantaged {
+		return ErrorTradeMessage{
+			Code:  codeNothingToConfirm,
+			Info:  "the trade is not at your disadvantage",
+			Fatal: false,
+		}.ConvertToWSMessage(*trackInfo)
+	}
+
+	player.Confirmed = true
+	if checkIfTradeFinished(trade) {
+		trade.TradeFinished = true
+	}
+
+	return updateMessageFromTrade(trade).ConvertToWSMessage(*trackInfo)
+}